@@ -4,11 +4,11 @@
 
 cd "$(dirname "$MILPA_COMMAND_REPO")" || @milpa.fail "could not cd into $MILPA_REPO_ROOT"
 @milpa.log info "Running unit tests"
-args=()
+args=( -race )
 after_run=complete
 if [[ "${MILPA_OPT_COVERAGE}" ]]; then
   after_run=success
-  args=( -coverprofile=coverage.out --coverpkg=./...)
+  args+=( -coverprofile=coverage.out --coverpkg=./...)
 fi
 gotestsum --format testname -- "$MILPA_ARG_SPEC" "${args[@]}" || exit 2
 @milpa.log "$after_run" "Unit tests passed"
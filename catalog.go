@@ -10,12 +10,14 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/upstream"
 	"github.com/coredns/coredns/request"
+	"github.com/hashicorp/consul/api"
 	"github.com/miekg/dns"
 )
 
@@ -24,86 +26,443 @@ var defaultEndpoint = "consul.service.consul:8500"
 var defaultTTL = uint32((5 * time.Minute).Seconds())
 var defaultACLTag = "coredns-acl"
 var defaultAliasTag = "coredns-alias"
-var DefaultLookup = func(ctx context.Context, state request.Request, target string) (*dns.Msg, error) {
+var defaultNameMetricsLimit = 100
+
+const (
+	// ConsistencyDefault has the leader answer without confirming its leadership.
+	ConsistencyDefault = "default"
+	// ConsistencyStale lets any server answer, regardless of the state of the leader.
+	ConsistencyStale = "stale"
+	// ConsistencyConsistent makes the leader confirm its leadership before answering.
+	ConsistencyConsistent = "consistent"
+)
+
+const (
+	// ACLAllow is the ACL action that answers a request.
+	ACLAllow = "allow"
+	// ACLDeny is the ACL action that refuses to answer a request.
+	ACLDeny = "deny"
+)
+
+const (
+	// DenyNext passes denied requests to the next plugin.
+	DenyNext = "next"
+	// DenyRefused answers denied requests with REFUSED.
+	DenyRefused = "refused"
+	// DenyNXDomain answers denied requests with NXDOMAIN.
+	DenyNXDomain = "nxdomain"
+	// DenyNoData answers denied requests with no records.
+	DenyNoData = "nodata"
+)
+
+var DefaultLookup = func(ctx context.Context, state request.Request, target string, qtype uint16) (*dns.Msg, error) {
 	recursor := upstream.New()
-	req := state.NewWithQuestion(target, dns.TypeA)
-	return recursor.Lookup(ctx, req, target, dns.TypeA)
+	req := state.NewWithQuestion(target, qtype)
+	return recursor.Lookup(ctx, req, target, qtype)
 }
 
 // Catalog holds published Consul Catalog services.
 type Catalog struct {
 	sync.RWMutex
-	Endpoint     string
+	// Endpoint is the consul agent to query when Endpoints is empty.
+	//
+	// Deprecated: use Endpoints, of which Endpoint is set to the first entry.
+	Endpoint string
+	// Endpoints are the consul agents to query, in order of preference.
+	Endpoints    []string
 	Scheme       string
+	TLS          api.TLSConfig
 	FQDN         []string
 	TTL          uint32
 	Token        string
+	TokenFile    *TokenFile
 	ProxyService string
 	ProxyTag     string
 	Networks     map[string][]*net.IPNet
 	ACLTag       string
 	AliasTag     string
-	Next         plugin.Handler
-	Zone         string
-	lastUpdate   time.Time
-	client       Client
-	kv           KVClient
-	Sources      []*Watch
-	metrics      *metrics.Metrics
+	// ACLDefault is the action taken for clients no ACL rule matches, either ACLAllow
+	// or ACLDeny.
+	ACLDefault string
+	// ACLDenyResponse is how denied requests are answered, one of DenyNext, DenyRefused,
+	// DenyNXDomain or DenyNoData.
+	ACLDenyResponse string
+	// ClientSubnetTrusted are the networks of forwarders whose EDNS0 client subnet option
+	// is used to evaluate ACLs, instead of their own address.
+	ClientSubnetTrusted []*net.IPNet
+	// ZonesPath is the KV key holding acl zones as json, keyed by zone name. They're
+	// watched for changes, and take precedence over Networks with the same name.
+	ZonesPath string
+	// AddressTags are the tagged addresses instances are served at, in order of preference,
+	// instead of their service address.
+	AddressTags []string
+	// HealthStatus is the worst health check status an instance can have to be served;
+	// the catalog is queried without regard to health checks if empty.
+	HealthStatus string
+	// HealthFallback serves every instance of a service when none are healthy.
+	HealthFallback bool
+	// Namespace to query the catalog and KV in, or NamespaceWildcard to also serve services
+	// in every namespace as `name.namespace.ns`. The token's namespace is used if empty.
+	Namespace string
+	// Partition to query the catalog and KV in. The token's partition is used if empty.
+	Partition string
+	// Consistency is the consistency mode of catalog and KV queries, one of
+	// ConsistencyDefault, ConsistencyStale or ConsistencyConsistent.
+	Consistency string
+	// MaxStale is how far behind the leader a stale result may be before the leader is
+	// queried instead, and the oldest cached result served when UseCache is set.
+	MaxStale time.Duration
+	// UseCache makes queries be answered by the agent's cache when possible.
+	UseCache bool
+	// Failover lists the datacenters to look for a service's addresses in, in order,
+	// when it has none in the agent's datacenter.
+	Failover []string
+	// Snapshot persists the services found by every watch, to serve them until each
+	// watch resolves after a restart.
+	Snapshot *Snapshot
+	// ReadyTimeout is how long after starting to report readiness even if some sources
+	// have not resolved yet; readiness waits for every source if zero.
+	ReadyTimeout time.Duration
+	// NameMetricsLimit is how many services requests are counted for by name, the rest
+	// being counted together; requests are not counted by name if zero.
+	NameMetricsLimit int
+	// DebugAddr is the address to serve the debug endpoint at, if any.
+	DebugAddr string
+
+	Next        plugin.Handler
+	Zone        string
+	lastUpdate  time.Time
+	client      Client
+	kv          KVClient
+	health      HealthClient
+	namespaces  NamespaceClient
+	Sources     []*Watch
+	metrics     *metrics.Metrics
+	ctx         context.Context
+	running     map[*Watch]context.CancelFunc
+	watches     sync.WaitGroup
+	snapshot    atomic.Pointer[published]
+	hostTurn    atomic.Uint64
+	stale       map[string]*SnapshotEntry
+	zones       map[string][]*net.IPNet
+	started     time.Time
+	pending     string
+	publishLock sync.Mutex
+
+	metricNamesLock sync.Mutex
+	metricNames     map[string]bool
 }
 
 // New returns a Catalog plugin.
 func New() *Catalog {
-	return &Catalog{
-		Endpoint: defaultEndpoint,
-		Scheme:   "http",
-		TTL:      defaultTTL,
-		ACLTag:   defaultACLTag,
-		AliasTag: defaultAliasTag,
-		Sources:  []*Watch{},
+	c := &Catalog{
+		Endpoint:        defaultEndpoint,
+		Endpoints:       []string{defaultEndpoint},
+		Scheme:          "http",
+		TTL:             defaultTTL,
+		ACLTag:          defaultACLTag,
+		AliasTag:        defaultAliasTag,
+		Consistency:     ConsistencyDefault,
+		ACLDefault:      ACLDeny,
+		ACLDenyResponse: DenyNext,
+		Sources:         []*Watch{},
+		running:         map[*Watch]context.CancelFunc{},
+		metricNames:     map[string]bool{},
 	}
+	c.snapshot.Store(&published{services: ServiceMap{}})
+	return c
 }
 
-// SetClient sets a consul client for a catalog.
-func (c *Catalog) SetClients(client Client, kv KVClient) {
+// SetClients sets the consul clients for a catalog.
+func (c *Catalog) SetClients(client Client, kv KVClient, health HealthClient, namespaces NamespaceClient) {
 	c.client = client
 	c.kv = kv
+	c.health = health
+	c.namespaces = namespaces
+}
+
+// labelEndpoints reports the consul endpoints of the catalog as used by a server and zone.
+func (c *Catalog) labelEndpoints(server, zone string) {
+	if client, ok := c.client.(endpointsCatalog); ok {
+		client.setLabels(server, zone)
+	}
+}
+
+// endpoints returns the consul agents to query, in order of preference.
+func (c *Catalog) endpoints() []string {
+	if len(c.Endpoints) == 0 && c.Endpoint != "" {
+		return []string{c.Endpoint}
+	}
+	return c.Endpoints
 }
 
-// Ready implements ready.Readiness.
+// queryNamespace returns the namespace queries should be made in, or an empty string to
+// use the token's.
+func (c *Catalog) queryNamespace() string {
+	if c.Namespace == NamespaceWildcard {
+		return ""
+	}
+	return c.Namespace
+}
+
+// aclToken returns the token queries should be made with, or an empty string to use the
+// client's.
+func (c *Catalog) aclToken() string {
+	if c.TokenFile == nil {
+		return ""
+	}
+	return c.TokenFile.Token()
+}
+
+// Ready implements ready.Readiness. The catalog is ready once every source has resolved,
+// or ReadyTimeout has passed since it started.
 func (c *Catalog) Ready() bool {
-	return c.client != nil && c.kv != nil
+	if c.client == nil || c.kv == nil {
+		return false
+	}
+
+	pending := c.Pending()
+	c.Lock()
+	defer c.Unlock()
+	waiting := strings.Join(pending, ", ")
+	changed := waiting != c.pending
+	c.pending = waiting
+
+	if len(pending) == 0 {
+		return true
+	}
+
+	if c.ReadyTimeout > 0 && !c.started.IsZero() && time.Since(c.started) > c.ReadyTimeout {
+		if changed {
+			Log.Warningf("Reporting ready after %v without having resolved: %s", c.ReadyTimeout, waiting)
+		}
+		return true
+	}
+
+	if changed {
+		Log.Infof("Waiting for sources to resolve: %s", waiting)
+	}
+	return false
+}
+
+// Pending returns the names of the sources that have not resolved yet.
+func (c *Catalog) Pending() []string {
+	c.RLock()
+	sources := c.Sources
+	c.RUnlock()
+
+	pending := []string{}
+	for _, src := range sources {
+		if !src.Ready() {
+			pending = append(pending, src.Name())
+		}
+	}
+	return pending
 }
 
 // LastUpdated returns the last time services changed.
 func (c *Catalog) LastUpdated() time.Time {
+	c.RLock()
+	defer c.RUnlock()
 	return c.lastUpdate
 }
 
-// Services returns a map of services to their target.
+// Services returns a map of services to their target, merged from every source. The
+// returned map is shared and must not be modified.
 func (c *Catalog) Services() ServiceMap {
+	return c.snapshot.Load().services
+}
+
+// published holds the services being served by a catalog.
+type published struct {
+	// services merged from every layer, the first layer with a name taking precedence.
+	services ServiceMap
+	// layers are the services of every source in order, followed by those loaded from
+	// Snapshot for sources that have not resolved yet.
+	layers []ServiceMap
+}
+
+// publish merges the services known to every source into a new snapshot, and swaps it
+// for the one currently being served. Services loaded from Snapshot are served in place
+// of those of sources that have not resolved yet, and every ACL rule is bound to the
+// networks of its zone once zones are read from ZonesPath.
+func (c *Catalog) publish() {
+	c.publishLock.Lock()
+	defer c.publishLock.Unlock()
+
+	c.RLock()
+	sources := c.Sources
+	stale := c.stale
+	zones := c.zones
+	c.RUnlock()
+
+	ready := map[string]bool{}
+	for _, src := range sources {
+		if src.Ready() {
+			ready[src.Name()] = true
+		}
+	}
+
+	if len(stale) > 0 && len(ready) == len(sources) {
+		Log.Infof("Every source resolved, no longer serving services from snapshot")
+		c.Lock()
+		c.stale = nil
+		c.Unlock()
+		c.Snapshot.Retain(ready)
+		stale = nil
+	}
+
+	layers := make([]ServiceMap, 0, len(sources)+len(stale))
+	for _, src := range sources {
+		layers = append(layers, src.Known())
+	}
+
+	for name, entry := range stale {
+		if !ready[name] {
+			layers = append(layers, entry.Services)
+		}
+	}
+
 	m := ServiceMap{}
-	for _, src := range c.Sources {
-		for n, s := range src.Known() {
+	for idx, layer := range layers {
+		if zones != nil {
+			bound := make(ServiceMap, len(layer))
+			for n, s := range layer {
+				bound[n] = bindACL(s, zones)
+			}
+			layer = bound
+			layers[idx] = bound
+		}
+
+		for n, s := range layer {
 			if _, ok := m[n]; ok {
-				Log.Warningf("Repeated service named %s from %s", n, src.Name())
+				if idx < len(sources) {
+					Log.Warningf("Repeated service named %s from %s", n, sources[idx].Name())
+				}
 				continue
 			}
 			m[n] = s
 		}
 	}
 
-	return m
+	c.snapshot.Store(&published{services: m, layers: layers})
+	c.forgetRequestNames(m)
+}
+
+// aclZones returns the networks of every acl zone by name. The returned map is shared
+// and must not be modified.
+func (c *Catalog) aclZones() map[string][]*net.IPNet {
+	c.RLock()
+	defer c.RUnlock()
+	if c.zones != nil {
+		return c.zones
+	}
+	return c.Networks
+}
+
+// enforcesACL returns whether requests are evaluated against service ACLs.
+func (c *Catalog) enforcesACL() bool {
+	return c.ZonesPath != "" || len(c.aclZones()) > 0
+}
+
+// setZones serves the acl zones read from ZonesPath, along with the Networks they don't
+// replace, and re-evaluates every service's ACL against them.
+func (c *Catalog) setZones(zones map[string][]*net.IPNet) {
+	merged := map[string][]*net.IPNet{}
+	for name, networks := range c.Networks {
+		merged[name] = networks
+	}
+	for name, networks := range zones {
+		merged[name] = networks
+	}
+
+	c.Lock()
+	c.zones = merged
+	c.Unlock()
+	c.publish()
+}
+
+// bindACL returns svc with every ACL rule matching the current networks of its zone,
+// or svc itself if they already do.
+func bindACL(svc *Service, zones map[string][]*net.IPNet) *Service {
+	changed := false
+	acl := make([]*ServiceACL, 0, len(svc.ACL))
+	for _, rule := range svc.ACL {
+		networks := zones[rule.Zone]
+		if !sameNetworks(rule.Networks, networks) {
+			bound := *rule
+			bound.Networks = networks
+			rule = &bound
+			changed = true
+		}
+		acl = append(acl, rule)
+	}
+
+	if !changed {
+		return svc
+	}
+
+	bound := *svc
+	bound.ACL = acl
+	return &bound
+}
+
+func sameNetworks(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadSnapshot serves the services stored in Snapshot until the sources that found them
+// resolve.
+func (c *Catalog) LoadSnapshot() error {
+	if c.Snapshot == nil {
+		return nil
+	}
+
+	entries, err := c.Snapshot.Load()
+	if err != nil {
+		return err
+	}
+
+	for name, entry := range entries {
+		Log.Infof("Serving %d stale records for %s from snapshot", len(entry.Services), name)
+	}
+
+	c.Lock()
+	c.stale = entries
+	c.Unlock()
+	c.publish()
+	return nil
 }
 
 // Name implements plugin.Handler.
 func (c *Catalog) Name() string { return "consul_catalog" }
 
+// ServiceFor returns the service answering for name, if any. Sources are looked up in
+// order, so a wildcard from one source takes precedence over an exact name from a later
+// one.
 func (c *Catalog) ServiceFor(name string) *Service {
-	c.RLock()
-	defer c.RUnlock()
-	for _, src := range c.Sources {
-		if svc := src.Get(name); svc != nil {
+	for _, services := range c.snapshot.Load().layers {
+		if svc := services.Find(name); svc != nil {
+			return svc
+		}
+	}
+	return nil
+}
+
+// FailoverFor returns the first counterpart of a service named name in the failover
+// datacenters that has addresses, if any.
+func (c *Catalog) FailoverFor(name string) *Service {
+	for _, dc := range c.Failover {
+		if svc := c.ServiceFor(inDatacenter(name, dc)); svc != nil && svc.reachable() {
+			Log.Debugf("Failing over %s to datacenter %s", name, dc)
 			return svc
 		}
 	}
@@ -111,10 +470,139 @@ func (c *Catalog) ServiceFor(name string) *Service {
 	return nil
 }
 
+// targetFor returns the service whose addresses answer for name, failing over to other
+// datacenters when it has none.
+func (c *Catalog) targetFor(name string) *Service {
+	target := c.ServiceFor(name)
+	if target != nil && target.reachable() {
+		return target
+	}
+
+	if failover := c.FailoverFor(name); failover != nil {
+		return failover
+	}
+
+	return target
+}
+
+// InstanceFor returns the service and instance for a host name like `node.service`, as
+// pointed to by SRV records.
+func (c *Catalog) InstanceFor(name string) (*Service, *ServiceInstance) {
+	labels := strings.Split(name, ".")
+	for idx := 1; idx < len(labels); idx++ {
+		svc := c.ServiceFor(strings.Join(labels[idx:], "."))
+		if svc == nil {
+			continue
+		}
+
+		if instance := svc.InstanceOn(strings.Join(labels[:idx], ".")); instance != nil {
+			return svc, instance
+		}
+	}
+
+	return nil, nil
+}
+
+// Start runs every source's watch until ctx is done. Sources added afterwards are
+// started as they're added.
+func (c *Catalog) Start(ctx context.Context) {
+	c.Lock()
+	defer c.Unlock()
+	c.ctx = ctx
+	if c.started.IsZero() {
+		c.started = time.Now()
+	}
+	for _, src := range c.Sources {
+		c.startSource(src)
+	}
+}
+
+// Stop cancels every running watch, aborting their in-flight queries, and waits for them
+// to finish.
+func (c *Catalog) Stop() {
+	c.Lock()
+	for src, cancel := range c.running {
+		cancel()
+		delete(c.running, src)
+	}
+	c.ctx = nil
+	c.Unlock()
+
+	c.watches.Wait()
+	if c.Snapshot != nil {
+		c.Snapshot.Flush()
+	}
+}
+
+// AddSource adds a watch to the catalog, starting it if the catalog is running.
+func (c *Catalog) AddSource(src *Watch) {
+	c.Lock()
+	defer c.Unlock()
+	c.Sources = append(c.Sources, src)
+	if c.ctx != nil {
+		c.startSource(src)
+	}
+}
+
+// RemoveSource stops a watch and removes it from the catalog.
+func (c *Catalog) RemoveSource(src *Watch) {
+	defer c.publish()
+	c.Lock()
+	defer c.Unlock()
+	sources := make([]*Watch, 0, len(c.Sources))
+	for _, existing := range c.Sources {
+		if existing != src {
+			sources = append(sources, existing)
+		}
+	}
+	c.Sources = sources
+
+	if cancel, ok := c.running[src]; ok {
+		cancel()
+		delete(c.running, src)
+	}
+	forgetWatchMetrics(src)
+	if c.Snapshot != nil {
+		c.Snapshot.Forget(src.Name())
+	}
+}
+
+// startSource must be called while holding the catalog's lock.
+func (c *Catalog) startSource(src *Watch) {
+	if _, ok := c.running[src]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.running[src] = cancel
+	c.watches.Add(1)
+	go func() {
+		defer c.watches.Done()
+		src.Run(ctx, c)
+	}()
+}
+
+// ReloadAll resolves every source once, including the ones added while doing so.
 func (c *Catalog) ReloadAll() error {
 	didUpdate := false
-	for _, src := range c.Sources {
-		changed, err := src.Resolve(c)
+	resolved := map[*Watch]bool{}
+	for {
+		var src *Watch
+		c.RLock()
+		for _, candidate := range c.Sources {
+			if !resolved[candidate] {
+				src = candidate
+				break
+			}
+		}
+		c.RUnlock()
+
+		if src == nil {
+			break
+		}
+		resolved[src] = true
+
+		changed, err := src.Resolve(context.Background(), c)
 		if err != nil {
 			return err
 		}
@@ -132,29 +620,104 @@ func (c *Catalog) ReloadAll() error {
 	return nil
 }
 
+// allows returns whether svc answers queries of type qtype from a client network, along
+// with the rule and network that decided it, or nil if ACLDefault did.
+func (c *Catalog) allows(svc *Service, client *net.IPNet, qtype uint16) (bool, *ServiceACL, *net.IPNet) {
+	if !c.enforcesACL() {
+		return true, nil, nil
+	}
+
+	allowed, rule, network := svc.Decide(client, qtype, time.Now())
+	if rule == nil {
+		return c.ACLDefault == ACLAllow, nil, nil
+	}
+	return allowed, rule, network
+}
+
 func (c *Catalog) parseACLString(svc *Service, acl string) error {
 	aclRules := regexp.MustCompile(`;\s*`).Split(acl, -1)
 	return c.parseACL(svc, aclRules)
 }
 
+// horizon returns the acl zone whose addresses of svc are served to a client: the most
+// specific zone containing the client that svc has addresses for, if any.
+func (c *Catalog) horizon(svc *Service, client *net.IPNet) string {
+	if len(svc.ZoneAddresses) == 0 {
+		return ""
+	}
+
+	zones := c.aclZones()
+	horizon := ""
+	specificity := -1
+	for name := range svc.ZoneAddresses {
+		for _, network := range zones[name] {
+			if !containsNetwork(network, client) {
+				continue
+			}
+
+			ones, _ := network.Mask.Size()
+			if ones > specificity || (ones == specificity && name < horizon) {
+				horizon = name
+				specificity = ones
+			}
+		}
+	}
+	return horizon
+}
+
+// aclRulePattern matches rules like `ACTION ZONE[, ZONE...] [for TYPE[, TYPE...]]
+// [during HH:MM-HH:MM]`.
+var aclRulePattern = regexp.MustCompile(`^\s*(\S+)\s+(.+?)(?:\s+for\s+(.+?))?(?:\s+during\s+(\S+))?\s*$`)
+
+var aclListSplitter = regexp.MustCompile(`,\s*`)
+
 func (c *Catalog) parseACL(svc *Service, rules []string) error {
 	Log.Debugf("Parsing ACL for %s: %s", svc.Name, rules)
+	zones := c.aclZones()
 	for _, rule := range rules {
-		ruleParts := strings.SplitN(rule, " ", 2)
-		if len(ruleParts) != 2 {
+		ruleParts := aclRulePattern.FindStringSubmatch(rule)
+		if ruleParts == nil {
 			return fmt.Errorf("could not parse acl rule <%s>", rule)
 		}
-		action := ruleParts[0]
-		for _, networkName := range regexp.MustCompile(`,\s*`).Split(ruleParts[1], -1) {
-			if ranges, ok := c.Networks[networkName]; ok {
-				svc.ACL = append(svc.ACL, &ServiceACL{
-					Action:   action,
-					Networks: ranges,
-				})
-			} else {
-				return fmt.Errorf("unknown network %s", networkName)
+		action := ruleParts[1]
+
+		var types []uint16
+		if ruleParts[3] != "" {
+			for _, typeName := range aclListSplitter.Split(ruleParts[3], -1) {
+				qtype, ok := dns.StringToType[strings.ToUpper(typeName)]
+				if !ok {
+					return fmt.Errorf("unknown query type %s in acl rule <%s>", typeName, rule)
+				}
+				types = append(types, qtype)
+			}
+		}
+
+		var window *TimeWindow
+		if ruleParts[4] != "" {
+			var err error
+			if window, err = ParseTimeWindow(ruleParts[4]); err != nil {
+				return err
 			}
 		}
+
+		for _, networkName := range aclListSplitter.Split(ruleParts[2], -1) {
+			ranges, ok := zones[networkName]
+			if !ok {
+				if c.ZonesPath == "" {
+					return fmt.Errorf("unknown network %s", networkName)
+				}
+				// the zone may be added to ZonesPath later, matching nothing until then
+				Log.Warningf("Unknown network %s in ACL for %s", networkName, svc.Name)
+			}
+
+			svc.ACL = append(svc.ACL, &ServiceACL{
+				Action:   action,
+				Zone:     networkName,
+				Networks: ranges,
+				Types:    types,
+				Window:   window,
+			})
+		}
 	}
 
 	return nil
@@ -7,6 +7,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,6 +22,9 @@ import (
 	"github.com/coredns/coredns/request"
 	"github.com/hashicorp/consul/api"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func staticServices() []byte {
@@ -39,6 +46,14 @@ func staticServices() []byte {
 			ACL:     []string{"allow private"},
 			Aliases: []string{"*.alias"},
 		},
+		"dual-stack": {
+			Addresses: []string{"192.168.100.5", "fd00::5"},
+			ACL:       []string{"allow private"},
+		},
+		"upstream": {
+			Target: "external",
+			ACL:    []string{"allow private"},
+		},
 	})
 
 	if err != nil {
@@ -54,6 +69,7 @@ func TestServeDNS(t *testing.T) {
 		"nomad.service.consul.":   {"192.168.100.1"},
 		"traefik.service.consul.": {"192.168.100.2"},
 		"git.service.consul.":     {"192.168.100.3", "192.168.100.4"},
+		"external.service.consul": {"192.168.100.6", "fd00::6"},
 	}
 
 	src := NewWatch(&WatchKVPath{Key: "static/path"})
@@ -76,19 +92,21 @@ func TestServeDNS(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 
-	DefaultLookup = func(ctx context.Context, req request.Request, target string) (*dns.Msg, error) {
+	DefaultLookup = func(ctx context.Context, req request.Request, target string, qtype uint16) (*dns.Msg, error) {
 		res := new(dns.Msg)
 		res.Answer = []dns.RR{}
 		ips, exists := allHosts[target]
 		if !exists {
 			res.SetRcode(req.Req, dns.RcodeNameError)
 		} else {
-			header := dns.RR_Header{Name: req.QName(), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}
+			header := dns.RR_Header{Name: req.QName(), Rrtype: qtype, Class: dns.ClassINET, Ttl: 300}
 			for _, ip := range ips {
-				res.Answer = append(res.Answer, &dns.A{
-					Hdr: header,
-					A:   net.ParseIP(ip),
-				})
+				addr := net.ParseIP(ip)
+				if qtype == dns.TypeAAAA && addr.To4() == nil {
+					res.Answer = append(res.Answer, &dns.AAAA{Hdr: header, AAAA: addr})
+				} else if qtype == dns.TypeA && addr.To4() != nil {
+					res.Answer = append(res.Answer, &dns.A{Hdr: header, A: addr})
+				}
 			}
 		}
 		return res, nil
@@ -206,6 +224,46 @@ func TestServeDNS(t *testing.T) {
 			expectedErr:   plugin.Error("consul_catalog", fmt.Errorf("no next plugin found")),
 			from:          "192.168.100.42",
 		},
+		{
+			qname:         "dual-stack.example.com",
+			qtype:         dns.TypeA,
+			expectedCode:  dns.RcodeSuccess,
+			expectedReply: []string{"192.168.100.5"},
+			expectedErr:   nil,
+			from:          "192.168.100.42",
+		},
+		{
+			qname:         "dual-stack.example.com",
+			qtype:         dns.TypeAAAA,
+			expectedCode:  dns.RcodeSuccess,
+			expectedReply: []string{"fd00::5"},
+			expectedErr:   nil,
+			from:          "192.168.100.42",
+		},
+		{
+			qname:         "git.example.com",
+			qtype:         dns.TypeAAAA,
+			expectedCode:  dns.RcodeSuccess,
+			expectedReply: []string{},
+			expectedErr:   nil,
+			from:          "192.168.100.42",
+		},
+		{
+			qname:         "upstream.example.com",
+			qtype:         dns.TypeA,
+			expectedCode:  dns.RcodeSuccess,
+			expectedReply: []string{"192.168.100.6"},
+			expectedErr:   nil,
+			from:          "192.168.100.42",
+		},
+		{
+			qname:         "upstream.example.com",
+			qtype:         dns.TypeAAAA,
+			expectedCode:  dns.RcodeSuccess,
+			expectedReply: []string{"fd00::6"},
+			expectedErr:   nil,
+			from:          "192.168.100.42",
+		},
 	}
 
 	ctx := context.TODO()
@@ -232,7 +290,7 @@ func TestServeDNS(t *testing.T) {
 				it.Fatalf("Test %d: Expected status code %d, but got %d", i, tc.expectedCode, code)
 			}
 
-			if len(tc.expectedReply) != 0 {
+			if tc.expectedErr == nil {
 				if rec == nil || rec.Msg == nil {
 					t.Fatal("Expected replies, got none")
 				}
@@ -242,14 +300,22 @@ func TestServeDNS(t *testing.T) {
 				}
 
 				for i, expected := range tc.expectedReply {
-					actual, ok := rec.Msg.Answer[i].(*dns.A)
-
-					if !ok {
+					var actual net.IP
+					switch record := rec.Msg.Answer[i].(type) {
+					case *dns.A:
+						actual = record.A
+					case *dns.AAAA:
+						actual = record.AAAA
+					default:
 						it.Fatalf("something crapped out: %v", rec.Msg.Answer)
 						return
 					}
 
-					if !actual.A.Equal(net.ParseIP(expected)) {
+					if record := rec.Msg.Answer[i]; record.Header().Rrtype != tc.qtype {
+						it.Errorf("Test %d: Expected record of type %d, but got %s", i, tc.qtype, record)
+					}
+
+					if !actual.Equal(net.ParseIP(expected)) {
 						it.Errorf("Test %d: Expected answer %s, but got %s", i, expected, actual)
 					}
 				}
@@ -257,3 +323,1184 @@ func TestServeDNS(t *testing.T) {
 		})
 	}
 }
+
+func TestServeSRV(t *testing.T) {
+	t.Parallel()
+	src := NewWatch(&WatchKVPath{Key: "static/path"})
+
+	c, _, kv := NewTestCatalog(true, src)
+	tkv := kv.(*testKVClient)
+	tkv.Keys = map[string]*api.KVPair{
+		"static/path": {
+			Key:   "static/path",
+			Value: staticServices(),
+		},
+	}
+	tkv.keysIndex++
+
+	if err := c.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qname         string
+		qtype         uint16
+		expectedReply []string
+		expectedExtra []string
+	}{
+		{
+			qname:         "_git._tcp.example.com",
+			qtype:         dns.TypeSRV,
+			expectedReply: []string{"node-192.168.100.3.git.example.com.:3000", "node-192.168.100.4.git.example.com.:3001"},
+			expectedExtra: []string{"node-192.168.100.3.git.example.com.=192.168.100.3", "node-192.168.100.4.git.example.com.=192.168.100.4"},
+		},
+		{
+			qname:         "git.example.com",
+			qtype:         dns.TypeSRV,
+			expectedReply: []string{"node-192.168.100.3.git.example.com.:3000", "node-192.168.100.4.git.example.com.:3001"},
+			expectedExtra: []string{"node-192.168.100.3.git.example.com.=192.168.100.3", "node-192.168.100.4.git.example.com.=192.168.100.4"},
+		},
+		{
+			qname:         "_nomad._tcp.example.com",
+			qtype:         dns.TypeSRV,
+			expectedReply: []string{"node-192.168.100.2.traefik.example.com.:443"},
+			expectedExtra: []string{"node-192.168.100.2.traefik.example.com.=192.168.100.2"},
+		},
+		{
+			qname:         "_dual-stack._tcp.example.com",
+			qtype:         dns.TypeSRV,
+			expectedReply: []string{},
+			expectedExtra: []string{},
+		},
+		{
+			qname:         "node-192.168.100.4.git.example.com",
+			qtype:         dns.TypeA,
+			expectedReply: []string{"192.168.100.4"},
+			expectedExtra: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tc.qname, tc.qtype), func(it *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(tc.qname), tc.qtype)
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"})
+			code, err := c.ServeDNS(context.TODO(), rec, req)
+			if err != nil {
+				it.Fatalf("Unexpected error: %s", err)
+			}
+
+			if code != dns.RcodeSuccess {
+				it.Fatalf("Expected status code %d, but got %d", dns.RcodeSuccess, code)
+			}
+
+			answers := []string{}
+			for _, rr := range rec.Msg.Answer {
+				switch record := rr.(type) {
+				case *dns.SRV:
+					answers = append(answers, fmt.Sprintf("%s:%d", record.Target, record.Port))
+				case *dns.A:
+					answers = append(answers, record.A.String())
+				default:
+					it.Fatalf("Unexpected answer: %s", rr)
+				}
+			}
+
+			if fmt.Sprint(answers) != fmt.Sprint(tc.expectedReply) {
+				it.Fatalf("Expected answers %v, got %v", tc.expectedReply, answers)
+			}
+
+			extra := []string{}
+			for _, rr := range rec.Msg.Extra {
+				record, ok := rr.(*dns.A)
+				if !ok {
+					it.Fatalf("Unexpected additional record: %s", rr)
+				}
+				extra = append(extra, fmt.Sprintf("%s=%s", record.Hdr.Name, record.A))
+			}
+
+			if fmt.Sprint(extra) != fmt.Sprint(tc.expectedExtra) {
+				it.Fatalf("Expected additional records %v, got %v", tc.expectedExtra, extra)
+			}
+		})
+	}
+}
+
+func TestConcurrentReloadAndServe(t *testing.T) {
+	c, client, _ := NewTestCatalog(true)
+	testclient := client.(*testCatalogClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				req := new(dns.Msg)
+				req.SetQuestion("git.example.com.", dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"})
+				if _, err := c.ServeDNS(ctx, rec, req); err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+
+				if len(rec.Msg.Answer) != 2 {
+					t.Errorf("Expected 2 answers, got %v", rec.Msg.Answer)
+					return
+				}
+
+				for name, svc := range c.Services() {
+					if svc == nil {
+						t.Errorf("Found nil service for %s", name)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := range 200 {
+		testclient.services["git"][0].Address = fmt.Sprintf("192.168.100.%d", 10+i%100)
+		testclient.Touch("git")
+		if i%2 == 0 {
+			testclient.Retag("nomad")
+		} else {
+			testclient.Retag("nomad", "coredns.enabled", "traefik.enable=true")
+		}
+
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestSourcePrecedence(t *testing.T) {
+	c, _, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "static/wildcard"}), NewWatch(&WatchKVPath{Key: "static/exact"}))
+	keys := kv.(*testKVClient).Keys
+	keys["static/wildcard"] = &api.KVPair{
+		Key:   "static/wildcard",
+		Value: []byte(`{"*.wiki": {"addresses": ["192.168.100.20"], "acl": ["allow private"]}, "docs": {"addresses": ["192.168.100.21"], "acl": ["allow private"]}}`),
+	}
+	keys["static/exact"] = &api.KVPair{
+		Key:   "static/exact",
+		Value: []byte(`{"en.wiki": {"addresses": ["192.168.100.30"], "acl": ["allow private"]}, "*.docs": {"addresses": ["192.168.100.31"], "acl": ["allow private"]}, "docs": {"addresses": ["192.168.100.32"], "acl": ["allow private"]}}`),
+	}
+
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	for name, expected := range map[string]string{
+		"en.wiki": "192.168.100.20",
+		"es.wiki": "192.168.100.20",
+		"docs":    "192.168.100.21",
+		"en.docs": "192.168.100.31",
+	} {
+		svc := c.ServiceFor(name)
+		if svc == nil || len(svc.Addresses) != 1 || svc.Addresses[0].String() != expected {
+			t.Fatalf("Expected %s to be served at %s, got %+v", name, expected, svc)
+		}
+	}
+}
+
+func TestServeDatacenters(t *testing.T) {
+	c, client, _ := NewTestCatalog(false)
+	testclient := client.(*testCatalogClient)
+	testclient.Datacenters = map[string]map[string][]*testServiceData{
+		"dc2": {
+			"git": {
+				{
+					Address: "10.2.0.3",
+					Port:    3000,
+					Tags:    []string{"coredns.enabled"},
+					Meta:    map[string]string{"coredns-acl": "allow private"},
+				},
+			},
+			"wiki": {
+				{
+					Address: "10.2.0.5",
+					Port:    80,
+					Tags:    []string{"coredns.enabled"},
+					Meta:    map[string]string{"coredns-acl": "allow private"},
+				},
+			},
+			"docs": {
+				{
+					Port: 80,
+					Tags: []string{"coredns.enabled"},
+					Meta: map[string]string{"coredns-acl": "allow private"},
+				},
+			},
+		},
+	}
+	c.AddSource(NewWatch(&WatchConsulCatalog{Tags: []string{"coredns.enabled"}, Match: TagMatchAny, Datacenter: "dc2"}))
+	c.Failover = []string{"dc2"}
+
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	query := func(qname string, qtype uint16) []string {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(qname), qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"})
+		if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Unexpected error for %s: %s", qname, err)
+		}
+
+		answers := []string{}
+		for _, rr := range rec.Msg.Answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				answers = append(answers, record.A.String())
+			case *dns.SRV:
+				answers = append(answers, fmt.Sprintf("%s:%d", record.Target, record.Port))
+			}
+		}
+		return answers
+	}
+
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		expected []string
+	}{
+		{qname: "git.example.com", qtype: dns.TypeA, expected: []string{"192.168.100.3", "192.168.100.4"}},
+		{qname: "git.dc2.dc.example.com", qtype: dns.TypeA, expected: []string{"10.2.0.3"}},
+		{qname: "wiki.dc2.dc.example.com", qtype: dns.TypeA, expected: []string{"10.2.0.5"}},
+		{qname: "wiki.example.com", qtype: dns.TypeA, expected: []string{"10.2.0.5"}},
+		{qname: "_git._tcp.dc2.dc.example.com", qtype: dns.TypeSRV, expected: []string{"node-10.2.0.3.git.dc2.dc.example.com.:3000"}},
+		{qname: "node-10.2.0.3.git.dc2.dc.example.com", qtype: dns.TypeA, expected: []string{"10.2.0.3"}},
+	}
+
+	for _, tc := range tests {
+		if answers := query(tc.qname, tc.qtype); fmt.Sprint(answers) != fmt.Sprint(tc.expected) {
+			t.Fatalf("Expected %v for %s, got %v", tc.expected, tc.qname, answers)
+		}
+	}
+
+	lookup := DefaultLookup
+	defer func() { DefaultLookup = lookup }()
+	looked := []string{}
+	DefaultLookup = func(ctx context.Context, req request.Request, target string, qtype uint16) (*dns.Msg, error) {
+		looked = append(looked, target)
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{test.A(target + " 5 IN A 10.2.0.7")}
+		return m, nil
+	}
+
+	if answers := query("docs.dc2.dc.example.com", dns.TypeA); fmt.Sprint(answers) != "[10.2.0.7]" || fmt.Sprint(looked) != "[docs.service.dc2.dc.consul]" {
+		t.Fatalf("Expected docs to be looked up at docs.service.dc2.dc.consul, got %v from %v", answers, looked)
+	}
+	DefaultLookup = lookup
+
+	c.HealthStatus = "passing"
+	for _, instance := range testclient.services["git"] {
+		instance.Status = "critical"
+	}
+	testclient.Touch("git")
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if answers := query("git.example.com", dns.TypeA); fmt.Sprint(answers) != "[10.2.0.3]" {
+		t.Fatalf("Expected git to fail over to dc2, got %v", answers)
+	}
+
+	if answers := query("_git._tcp.example.com", dns.TypeSRV); fmt.Sprint(answers) != "[node-10.2.0.3.git.dc2.dc.example.com.:3000]" {
+		t.Fatalf("Expected git SRV to fail over to dc2, got %v", answers)
+	}
+}
+
+func TestServeNamespaces(t *testing.T) {
+	teamA := func() map[string]map[string][]*testServiceData {
+		return map[string]map[string][]*testServiceData{
+			"team-a": {
+				"api": {
+					{
+						Address: "10.3.0.1",
+						Port:    8080,
+						Tags:    []string{"coredns.enabled"},
+						Meta:    map[string]string{"coredns-acl": "allow private"},
+					},
+				},
+				"web": {
+					{
+						Port: 80,
+						Tags: []string{"coredns.enabled"},
+						Meta: map[string]string{"coredns-acl": "allow private"},
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("every namespace", func(t *testing.T) {
+		c, client, _ := NewTestCatalog(false)
+		testclient := client.(*testCatalogClient)
+		testclient.Namespaces = teamA()
+		c.Namespace = NamespaceWildcard
+		c.AddSource(NewWatch(&WatchConsulNamespaces{Tags: []string{"coredns.enabled"}, Match: TagMatchAny}))
+
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		if svc := c.ServiceFor("git"); svc == nil {
+			t.Fatalf("Expected git to be served, got %+v", c.Services())
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("api.team-a.ns.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"})
+		if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if len(rec.Msg.Answer) != 1 || !rec.Msg.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.3.0.1")) {
+			t.Fatalf("Unexpected answer for api.team-a.ns: %v", rec.Msg.Answer)
+		}
+
+		lookup := DefaultLookup
+		defer func() { DefaultLookup = lookup }()
+		looked := ""
+		DefaultLookup = func(ctx context.Context, req request.Request, target string, qtype uint16) (*dns.Msg, error) {
+			looked = target
+			return new(dns.Msg), nil
+		}
+
+		req.SetQuestion("web.team-a.ns.example.com.", dns.TypeA)
+		if _, err := c.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"}), req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if looked != "web.service.team-a.ns.consul" {
+			t.Fatalf("Expected web to be looked up at web.service.team-a.ns.consul, got %s", looked)
+		}
+
+		delete(testclient.Namespaces, "team-a")
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		if svc := c.ServiceFor("api.team-a.ns"); svc != nil {
+			t.Fatalf("Expected api.team-a.ns to stop being served, got %+v", svc)
+		}
+
+		for _, src := range c.Sources {
+			if strings.Contains(src.Name(), "team-a") {
+				t.Fatalf("Expected watch %s to be stopped", src.Name())
+			}
+		}
+	})
+
+	t.Run("single namespace and partition", func(t *testing.T) {
+		c, client, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "static/path"}))
+		testclient := client.(*testCatalogClient)
+		testclient.Namespaces = teamA()
+		c.Namespace = "team-a"
+		c.Partition = "eng"
+
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		if svc := c.ServiceFor("api"); svc == nil {
+			t.Fatalf("Expected api to be served from team-a, got %+v", c.Services())
+		}
+
+		if svc := c.ServiceFor("git"); svc != nil {
+			t.Fatalf("Expected git not to be served from team-a, got %+v", svc)
+		}
+
+		if opts := testclient.LastOptions; opts.Namespace != "team-a" || opts.Partition != "eng" {
+			t.Fatalf("Unexpected catalog query options: %+v", opts)
+		}
+
+		if opts := kv.(*testKVClient).LastOptions; opts.Namespace != "team-a" || opts.Partition != "eng" {
+			t.Fatalf("Unexpected kv query options: %+v", opts)
+		}
+	})
+}
+
+func TestSnapshotColdStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	c, _, _ := NewTestCatalog(false)
+	c.Snapshot = NewSnapshot(path)
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the snapshot to be written after a delay, got %v", err)
+	}
+	c.Snapshot.Flush()
+
+	restarted, client, _ := NewTestCatalog(false)
+	restarted.Snapshot = NewSnapshot(path)
+	if svc := restarted.ServiceFor("git"); svc != nil {
+		t.Fatalf("Expected no services before loading the snapshot, got %+v", svc)
+	}
+
+	if err := restarted.LoadSnapshot(); err != nil {
+		t.Fatalf("could not load snapshot: %s", err)
+	}
+
+	svc := restarted.ServiceFor("git")
+	if svc == nil || len(svc.Addresses) != 2 || !svc.Addresses[0].Equal(net.ParseIP("192.168.100.3")) {
+		t.Fatalf("Expected git to be served from the snapshot, got %+v", svc)
+	}
+
+	if !svc.RespondsTo(net.ParseIP("10.42.0.1")) || svc.RespondsTo(net.ParseIP("192.168.1.1")) {
+		t.Fatalf("Expected git's ACL to be restored from the snapshot, got %+v", svc.ACL)
+	}
+
+	client.(*testCatalogClient).DeleteService("nomad")
+	if err := restarted.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if svc := restarted.ServiceFor("nomad"); svc != nil {
+		t.Fatalf("Expected nomad to stop being served once resolved, got %+v", svc)
+	}
+
+	if svc := restarted.ServiceFor("git"); svc == nil {
+		t.Fatalf("Expected git to be served once resolved")
+	}
+
+	restarted.Snapshot.Flush()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read snapshot: %s", err)
+	}
+
+	if strings.Contains(string(data), "consul catalog service nomad") {
+		t.Fatalf("Expected nomad to be removed from the snapshot, got %s", data)
+	}
+}
+
+func TestReady(t *testing.T) {
+	c, _, _ := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "static/path"}))
+
+	if c.Ready() {
+		t.Fatalf("Expected catalog not to be ready before resolving")
+	}
+
+	expected := []string{"static services from key static/path", "consul catalog services tagged coredns.enabled"}
+	if pending := c.Pending(); fmt.Sprint(pending) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v to be pending, got %v", expected, pending)
+	}
+
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if !c.Ready() {
+		t.Fatalf("Expected catalog to be ready, still waiting for %v", c.Pending())
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		c, _, _ := NewTestCatalog(false)
+		c.ReadyTimeout = 10 * time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.Start(ctx)
+		defer c.Stop()
+
+		if c.Ready() {
+			t.Fatalf("Expected catalog not to be ready before the timeout")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		if !c.Ready() {
+			t.Fatalf("Expected catalog to be ready after the timeout")
+		}
+
+		if pending := c.Pending(); len(pending) != 1 {
+			t.Fatalf("Expected the catalog watch to still be pending, got %v", pending)
+		}
+	})
+}
+
+func TestWatchMetrics(t *testing.T) {
+	src := NewWatch(&WatchKVPath{Key: "metrics/path"})
+	c, _, kv := NewTestCatalog(false, src)
+	tkv := kv.(*testKVClient)
+	tkv.Keys["metrics/path"] = &api.KVPair{Key: "metrics/path", Value: staticServices()}
+
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	name := "kv:metrics/path"
+	if resolved := testutil.ToFloat64(WatchResolveCount.WithLabelValues(name, "success")); resolved != 1 {
+		t.Fatalf("Expected 1 successful resolve, got %v", resolved)
+	}
+
+	if index := testutil.ToFloat64(WatchLastIndex.WithLabelValues(name)); index != float64(src.LastIndex) {
+		t.Fatalf("Expected last index %d, got %v", src.LastIndex, index)
+	}
+
+	if refreshed := testutil.ToFloat64(WatchLastRefresh.WithLabelValues(name)); refreshed < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Fatalf("Expected a recent refresh, got %v", refreshed)
+	}
+
+	if services := testutil.ToFloat64(WatchRecords.WithLabelValues(name, "service")); services != 6 {
+		t.Fatalf("Expected 6 services, got %v", services)
+	}
+
+	if aliases := testutil.ToFloat64(WatchRecords.WithLabelValues(name, "alias")); aliases != 1 {
+		t.Fatalf("Expected 1 alias, got %v", aliases)
+	}
+
+	tkv.Keys["metrics/path"] = &api.KVPair{Key: "metrics/path", Value: []byte("not json")}
+	if err := c.ReloadAll(); err == nil {
+		t.Fatalf("Expected an error processing invalid json")
+	}
+
+	if failed := testutil.ToFloat64(WatchResolveCount.WithLabelValues(name, "error")); failed != 1 {
+		t.Fatalf("Expected 1 failed resolve, got %v", failed)
+	}
+
+	c.RemoveSource(src)
+
+	if resolved := testutil.ToFloat64(WatchResolveCount.WithLabelValues(name, "success")); resolved != 0 {
+		t.Fatalf("Expected metrics for %s to be removed, got %v resolves", name, resolved)
+	}
+
+	t.Run("service watches share their catalog's source", func(t *testing.T) {
+		c, client, _ := NewTestCatalog(false)
+		testclient := client.(*testCatalogClient)
+		testclient.Datacenters = map[string]map[string][]*testServiceData{"metrics-dc": {}}
+		for _, svc := range []string{"git", "wiki"} {
+			testclient.Datacenters["metrics-dc"][svc] = []*testServiceData{
+				{Address: "10.9.0.1", Port: 80, Tags: []string{"coredns.enabled"}, Meta: map[string]string{"coredns-acl": "allow private"}},
+			}
+		}
+		c.AddSource(NewWatch(&WatchConsulCatalog{Tags: []string{"coredns.enabled"}, Match: TagMatchAny, Datacenter: "metrics-dc"}))
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		if services := testutil.ToFloat64(WatchRecords.WithLabelValues("services:metrics-dc.dc", "service")); services != 2 {
+			t.Fatalf("Expected 2 services, got %v", services)
+		}
+
+		if resolved := testutil.ToFloat64(WatchResolveCount.WithLabelValues("catalog:metrics-dc.dc", "success")); resolved != 1 {
+			t.Fatalf("Expected 1 successful catalog resolve, got %v", resolved)
+		}
+
+		delete(testclient.Datacenters["metrics-dc"], "wiki")
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		if services := testutil.ToFloat64(WatchRecords.WithLabelValues("services:metrics-dc.dc", "service")); services != 1 {
+			t.Fatalf("Expected 1 service once wiki is gone, got %v", services)
+		}
+	})
+}
+
+func TestServiceRequestMetrics(t *testing.T) {
+	c, client, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "static/path"}))
+	kv.(*testKVClient).Keys["static/path"] = &api.KVPair{Key: "static/path", Value: staticServices()}
+	c.NameMetricsLimit = 2
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	for _, qname := range []string{"git", "alias", "something.alias", "git", "domain", "nomad"} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(qname+".example.com"), dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"})
+		if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Unexpected error for %s: %s", qname, err)
+		}
+	}
+
+	expected := map[string]float64{"git": 2, "alias": 2, "other": 2, "something.alias": 0, "domain": 0}
+	for service, count := range expected {
+		if actual := testutil.ToFloat64(RequestServiceCount.WithLabelValues("", "", service)); actual != count {
+			t.Errorf("Expected %v requests for %s, got %v", count, service, actual)
+		}
+	}
+
+	// services no longer served give up their names to others
+	client.(*testCatalogClient).DeleteService("git")
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("domain.example.com.", dns.TypeA)
+	if _, err := c.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.42"}), req); err != nil {
+		t.Fatalf("Unexpected error for domain: %s", err)
+	}
+
+	expected = map[string]float64{"git": 0, "alias": 2, "other": 2, "domain": 1}
+	for service, count := range expected {
+		if actual := testutil.ToFloat64(RequestServiceCount.WithLabelValues("", "", service)); actual != count {
+			t.Errorf("Expected %v requests for %s after git was removed, got %v", count, service, actual)
+		}
+	}
+
+	observed := func() uint64 {
+		m := &dto.Metric{}
+		if err := RequestDuration.WithLabelValues("", "").(prometheus.Histogram).Write(m); err != nil {
+			t.Fatalf("could not read request durations: %s", err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	before := observed()
+	for _, tc := range []struct{ qname, from string }{{"unknown", "192.168.100.42"}, {"git", "192.168.1.1"}} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(tc.qname+".example.com"), dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.from})
+		_, _ = c.ServeDNS(context.TODO(), rec, req)
+	}
+
+	if after := observed(); after != before+2 {
+		t.Fatalf("Expected unknown and denied requests to be observed, got %d more", after-before)
+	}
+}
+
+func TestACLDenyResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		def      string
+		response string
+		qname    string
+		from     string
+		rcode    int
+		answers  int
+		err      bool
+		soa      bool
+	}{
+		{name: "next", def: ACLDeny, response: DenyNext, qname: "git", from: "192.168.1.1", err: true},
+		{name: "refused", def: ACLDeny, response: DenyRefused, qname: "git", from: "192.168.1.1", rcode: dns.RcodeRefused},
+		{name: "nxdomain", def: ACLDeny, response: DenyNXDomain, qname: "git", from: "192.168.1.1", rcode: dns.RcodeNameError, soa: true},
+		{name: "nodata", def: ACLDeny, response: DenyNoData, qname: "git", from: "192.168.1.1", rcode: dns.RcodeSuccess, soa: true},
+		{name: "default deny", def: ACLDeny, response: DenyRefused, qname: "nomad", from: "192.168.1.1", rcode: dns.RcodeRefused},
+		{name: "default allow", def: ACLAllow, response: DenyRefused, qname: "nomad", from: "192.168.1.1", rcode: dns.RcodeSuccess, answers: 1, soa: true},
+		{name: "default allow keeps explicit deny", def: ACLAllow, response: DenyRefused, qname: "git", from: "192.168.1.1", rcode: dns.RcodeRefused},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _, _ := NewTestCatalog(true)
+			c.ACLDefault = tc.def
+			c.ACLDenyResponse = tc.response
+			if !tc.err {
+				c.Next = testZone(t)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(tc.qname+".example.com"), dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.from})
+			_, err := c.ServeDNS(context.TODO(), rec, req)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("Expected the request to be passed to the next plugin")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if rec.Msg.Rcode != tc.rcode || len(rec.Msg.Answer) != tc.answers {
+				t.Fatalf("Expected rcode %d with %d answers, got %s", tc.rcode, tc.answers, rec.Msg)
+			}
+
+			if _, ok := firstSOA(rec.Msg.Ns); ok != tc.soa {
+				t.Fatalf("Expected SOA in authority: %v, got %s", tc.soa, rec.Msg)
+			}
+		})
+	}
+}
+
+func firstSOA(rrs []dns.RR) (*dns.SOA, bool) {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, true
+		}
+	}
+	return nil, false
+}
+
+func TestClientSubnetACL(t *testing.T) {
+	c, _, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "subnet/path"}))
+	kv.(*testKVClient).Keys["subnet/path"] = &api.KVPair{
+		Key:   "subnet/path",
+		Value: []byte(`{"dual-stack": {"addresses": ["192.168.100.7", "fd00:1::7"], "acl": ["allow private6, private"]}}`),
+	}
+	_, private6, _ := net.ParseCIDR("fd00:1::/64")
+	c.Networks["private6"] = []*net.IPNet{private6}
+	_, forwarders, _ := net.ParseCIDR("10.0.0.0/24")
+	c.ClientSubnetTrusted = []*net.IPNet{forwarders}
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		from    string
+		qtype   uint16
+		subnet  string
+		allowed bool
+	}{
+		{name: "ipv6 client in zone", from: "fd00:1::42", qtype: dns.TypeAAAA, allowed: true},
+		{name: "ipv6 client outside zone", from: "fd00:2::42", qtype: dns.TypeAAAA},
+		{name: "ipv4 client in zone", from: "192.168.100.42", qtype: dns.TypeA, allowed: true},
+		{name: "trusted forwarder", from: "10.0.0.53", qtype: dns.TypeA, subnet: "192.168.100.0/24", allowed: true},
+		{name: "trusted forwarder with ipv6 subnet", from: "10.0.0.53", qtype: dns.TypeAAAA, subnet: "fd00:1::/64", allowed: true},
+		{name: "trusted forwarder with subnet wider than zone", from: "10.0.0.53", qtype: dns.TypeA, subnet: "192.168.0.0/16"},
+		{name: "trusted forwarder with subnet outside zone", from: "10.0.0.53", qtype: dns.TypeA, subnet: "192.168.1.0/24"},
+		{name: "trusted forwarder without subnet", from: "10.0.0.53", qtype: dns.TypeA},
+		{name: "untrusted forwarder", from: "10.1.0.53", qtype: dns.TypeA, subnet: "192.168.100.0/24"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("dual-stack.example.com.", tc.qtype)
+			var ecs *dns.EDNS0_SUBNET
+			if tc.subnet != "" {
+				_, subnet, _ := net.ParseCIDR(tc.subnet)
+				ones, _ := subnet.Mask.Size()
+				ecs = &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: subnet.IP}
+				if subnet.IP.To4() == nil {
+					ecs.Family = 2
+				}
+				req.SetEdns0(4096, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, ecs)
+			}
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.from})
+			_, err := c.ServeDNS(context.TODO(), rec, req)
+			if !tc.allowed {
+				if err == nil {
+					t.Fatalf("Expected request to be denied, got %s", rec.Msg)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if len(rec.Msg.Answer) != 1 {
+				t.Fatalf("Expected an answer, got %s", rec.Msg)
+			}
+
+			if ecs == nil {
+				return
+			}
+
+			opt := rec.Msg.IsEdns0()
+			if opt == nil || len(opt.Option) != 1 {
+				t.Fatalf("Expected client subnet in reply, got %s", rec.Msg)
+			}
+
+			if scoped := opt.Option[0].(*dns.EDNS0_SUBNET); scoped.SourceScope != ecs.SourceNetmask {
+				t.Fatalf("Expected reply scoped to /%d, got %s", ecs.SourceNetmask, scoped)
+			}
+		})
+	}
+}
+
+func TestACLRuleRestrictions(t *testing.T) {
+	c, _, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "restricted/path"}))
+	kv.(*testKVClient).Keys["restricted/path"] = &api.KVPair{
+		Key: "restricted/path",
+		Value: []byte(`{
+			"printer": {"addresses": ["192.168.100.9"], "acl": ["allow guest for SRV, txt", "allow private during 08:00-20:00", "deny private"]},
+			"backup": {"addresses": ["192.168.100.10"], "acl": ["allow private for A during 22:00-06:00"]},
+			"bad-type": {"addresses": ["192.168.100.11"], "acl": ["allow guest for BOGUS"]},
+			"bad-window": {"addresses": ["192.168.100.12"], "acl": ["allow guest during 8-20"]}
+		}`),
+	}
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	for _, name := range []string{"bad-type", "bad-window"} {
+		if svc := c.ServiceFor(name); svc != nil {
+			t.Fatalf("Service %s found with invalid acl: %+v", name, svc.ACL)
+		}
+	}
+
+	printer := c.ServiceFor("printer")
+	if printer == nil {
+		t.Fatalf("Service printer not found, got: %+v", c.Services())
+	}
+
+	if window := printer.ACL[1].Window; window == nil || window.String() != "08:00-20:00" {
+		t.Fatalf("Unexpected window for private: %v", window)
+	}
+
+	backup := c.ServiceFor("backup")
+	if backup == nil {
+		t.Fatalf("Service backup not found, got: %+v", c.Services())
+	}
+
+	_, guest, _ := net.ParseCIDR("192.168.1.42/32")
+	_, private, _ := net.ParseCIDR("192.168.100.42/32")
+	day := time.Date(2024, 3, 14, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 3, 14, 23, 30, 0, 0, time.UTC)
+	dawn := time.Date(2024, 3, 14, 5, 59, 59, 0, time.UTC)
+	closing := time.Date(2024, 3, 14, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		svc     *Service
+		client  *net.IPNet
+		qtype   uint16
+		at      time.Time
+		allowed bool
+		zone    string
+	}{
+		{name: "listed type", svc: printer, client: guest, qtype: dns.TypeSRV, at: day, allowed: true, zone: "guest"},
+		{name: "listed lowercase type", svc: printer, client: guest, qtype: dns.TypeTXT, at: night, allowed: true, zone: "guest"},
+		{name: "unlisted type", svc: printer, client: guest, qtype: dns.TypeA, at: day},
+		{name: "within window", svc: printer, client: private, qtype: dns.TypeA, at: day, allowed: true, zone: "private"},
+		{name: "window end is exclusive", svc: printer, client: private, qtype: dns.TypeA, at: closing, zone: "private"},
+		{name: "outside window falls through", svc: printer, client: private, qtype: dns.TypeA, at: night, zone: "private"},
+		{name: "window across midnight", svc: backup, client: private, qtype: dns.TypeA, at: night, allowed: true, zone: "private"},
+		{name: "window across midnight, next day", svc: backup, client: private, qtype: dns.TypeA, at: dawn, allowed: true, zone: "private"},
+		{name: "outside window across midnight", svc: backup, client: private, qtype: dns.TypeA, at: day},
+		{name: "type and window", svc: backup, client: private, qtype: dns.TypeAAAA, at: night},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, rule, _ := tc.svc.Decide(tc.client, tc.qtype, tc.at)
+			if allowed != tc.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v by %+v", tc.allowed, allowed, rule)
+			}
+
+			zone := ""
+			if rule != nil {
+				zone = rule.Zone
+			}
+			if zone != tc.zone {
+				t.Fatalf("Expected a rule for zone %q to decide, got %+v", tc.zone, rule)
+			}
+		})
+	}
+
+	t.Run("serve by type", func(t *testing.T) {
+		for qtype, allowed := range map[uint16]bool{dns.TypeSRV: true, dns.TypeA: false} {
+			req := new(dns.Msg)
+			req.SetQuestion("printer.example.com.", qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.1.42"})
+			_, err := c.ServeDNS(context.TODO(), rec, req)
+			if allowed != (err == nil) {
+				t.Fatalf("Expected %s to be allowed: %v, got %v", dns.TypeToString[qtype], allowed, err)
+			}
+		}
+	})
+}
+
+func TestSplitHorizon(t *testing.T) {
+	c, client, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "horizon/path"}))
+	_, vpn, _ := net.ParseCIDR("10.8.0.0/24")
+	c.Networks["vpn"] = []*net.IPNet{vpn}
+	kv.(*testKVClient).Keys["horizon/path"] = &api.KVPair{
+		Key: "horizon/path",
+		Value: []byte(`{
+			"intranet": {"addresses": ["192.168.100.20"], "addresses_by_zone": {"guest": ["192.168.1.20"], "vpn": ["10.8.0.20", "not-an-ip"]}, "acl": ["allow private, guest, vpn"]},
+			"vpn-only": {"addresses_by_zone": {"vpn": ["10.8.0.21"]}, "acl": ["allow private, vpn"]}
+		}`),
+	}
+	client.(*testCatalogClient).services["wiki"] = []*testServiceData{
+		{
+			Address:         "192.168.100.30",
+			Port:            8080,
+			Tags:            []string{"coredns.enabled"},
+			Meta:            map[string]string{"coredns-acl": "allow private, vpn"},
+			TaggedAddresses: map[string]string{"vpn": "10.8.0.30", "wan": "203.0.113.30"},
+		},
+	}
+	client.(*testCatalogClient).services["bridged"] = []*testServiceData{
+		{
+			Address:             "192.168.100.33",
+			ServiceAddress:      "172.17.0.33",
+			Port:                8080,
+			Tags:                []string{"coredns.enabled"},
+			Meta:                map[string]string{"coredns-acl": "allow private, vpn"},
+			NodeTaggedAddresses: map[string]string{"vpn": "10.8.0.33"},
+		},
+	}
+	client.(*testCatalogClient).services["wiki-mixed"] = []*testServiceData{
+		{
+			Address:         "192.168.100.31",
+			Port:            8080,
+			Tags:            []string{"coredns.enabled"},
+			Meta:            map[string]string{"coredns-acl": "allow private, vpn"},
+			TaggedAddresses: map[string]string{"vpn": "10.8.0.31"},
+		},
+		{
+			Address: "192.168.100.32",
+			Port:    8081,
+			Tags:    []string{"coredns.enabled"},
+			Meta:    map[string]string{"coredns-acl": "allow private, vpn"},
+		},
+	}
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		from     string
+		expected []string
+	}{
+		{name: "static default", qname: "intranet", qtype: dns.TypeA, from: "192.168.100.5", expected: []string{"192.168.100.20"}},
+		{name: "static zone", qname: "intranet", qtype: dns.TypeA, from: "192.168.1.5", expected: []string{"192.168.1.20"}},
+		{name: "static other zone", qname: "intranet", qtype: dns.TypeA, from: "10.8.0.5", expected: []string{"10.8.0.20"}},
+		{name: "static zone only", qname: "vpn-only", qtype: dns.TypeA, from: "10.8.0.5", expected: []string{"10.8.0.21"}},
+		{name: "static outside zones", qname: "vpn-only", qtype: dns.TypeA, from: "192.168.100.5", expected: []string{}},
+		{name: "catalog default", qname: "wiki", qtype: dns.TypeA, from: "192.168.100.5", expected: []string{"192.168.100.30"}},
+		{name: "catalog tagged", qname: "wiki", qtype: dns.TypeA, from: "10.8.0.5", expected: []string{"10.8.0.30"}},
+		{name: "catalog instance tagged", qname: "node-192.168.100.30.wiki", qtype: dns.TypeA, from: "10.8.0.5", expected: []string{"10.8.0.30"}},
+		{name: "catalog srv glue tagged", qname: "_wiki._tcp", qtype: dns.TypeSRV, from: "10.8.0.5", expected: []string{"10.8.0.30"}},
+		{name: "catalog service address over node tagged", qname: "bridged", qtype: dns.TypeA, from: "10.8.0.5", expected: []string{"172.17.0.33"}},
+		{name: "catalog partially tagged", qname: "wiki-mixed", qtype: dns.TypeA, from: "10.8.0.5", expected: []string{"10.8.0.31", "192.168.100.32"}},
+		{name: "catalog partially tagged srv glue", qname: "_wiki-mixed._tcp", qtype: dns.TypeSRV, from: "10.8.0.5", expected: []string{"10.8.0.31", "192.168.100.32"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(tc.qname+".example.com"), tc.qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.from})
+			if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			records := rec.Msg.Answer
+			if tc.qtype == dns.TypeSRV {
+				records = rec.Msg.Extra
+			}
+
+			found := []string{}
+			for _, rr := range records {
+				if a, ok := rr.(*dns.A); ok {
+					found = append(found, a.A.String())
+				}
+			}
+
+			if strings.Join(found, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("Expected %v, got %s", tc.expected, rec.Msg)
+			}
+		})
+	}
+}
+
+func TestInstanceAddresses(t *testing.T) {
+	instances := map[string]*testServiceData{
+		"node-address":    {Address: "192.168.100.40"},
+		"service-address": {Address: "192.168.100.41", ServiceAddress: "192.168.100.141", NodeTaggedAddresses: map[string]string{"lan_ipv4": "10.0.0.41"}},
+		"hostname":        {Address: "192.168.100.42", ServiceAddress: "db.internal.example.net"},
+		"tagged": {
+			Address:             "192.168.100.43",
+			TaggedAddresses:     map[string]string{"wan_ipv4": "203.0.113.43"},
+			NodeTaggedAddresses: map[string]string{"lan_ipv4": "10.0.0.43"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		health   string
+		tags     []string
+		expected map[string]string
+	}{
+		{
+			name: "service address or node",
+			expected: map[string]string{
+				"node-address":    "192.168.100.40",
+				"service-address": "192.168.100.141",
+				"hostname":        "db.internal.example.net",
+				"tagged":          "192.168.100.43",
+			},
+		},
+		{
+			name:   "service address or node, from health",
+			health: api.HealthPassing,
+			expected: map[string]string{
+				"node-address":    "192.168.100.40",
+				"service-address": "192.168.100.141",
+				"hostname":        "db.internal.example.net",
+				"tagged":          "192.168.100.43",
+			},
+		},
+		{
+			name: "preferred service tag",
+			tags: []string{"wan_ipv4", "lan_ipv4"},
+			expected: map[string]string{
+				"service-address": "192.168.100.141",
+				"tagged":          "203.0.113.43",
+			},
+		},
+		{
+			name:   "preferred node tag",
+			health: api.HealthPassing,
+			tags:   []string{"lan_ipv4"},
+			expected: map[string]string{
+				"node-address":    "192.168.100.40",
+				"service-address": "192.168.100.141",
+				"tagged":          "10.0.0.43",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, client, _ := NewTestCatalog(false)
+			c.HealthStatus = tc.health
+			c.AddressTags = tc.tags
+			for name, instance := range instances {
+				data := *instance
+				data.Port = 80
+				data.Tags = []string{"coredns.enabled"}
+				data.Meta = map[string]string{"coredns-acl": "allow private"}
+				client.(*testCatalogClient).services[name] = []*testServiceData{&data}
+			}
+			if err := c.ReloadAll(); err != nil {
+				t.Fatalf("could not fetch services: %s", err)
+			}
+
+			for name, expected := range tc.expected {
+				svc := c.ServiceFor(name)
+				if svc == nil || len(svc.Instances) != 1 {
+					t.Fatalf("Expected one instance of %s, got %+v", name, svc)
+				}
+
+				address := svc.Instances[0].Host
+				if addr := svc.Instances[0].Address; addr != nil {
+					address = addr.String()
+				}
+				if address != expected {
+					t.Fatalf("Expected %s to be served at %s, got %s", name, expected, address)
+				}
+			}
+		})
+	}
+
+	t.Run("hostname answers", func(t *testing.T) {
+		lookup := DefaultLookup
+		defer func() { DefaultLookup = lookup }()
+		DefaultLookup = func(ctx context.Context, req request.Request, target string, qtype uint16) (*dns.Msg, error) {
+			res := new(dns.Msg)
+			if target == "db.internal.example.net." && qtype == dns.TypeA {
+				res.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.0.0.42")}}
+			}
+			return res, nil
+		}
+
+		c, client, _ := NewTestCatalog(false)
+		data := *instances["hostname"]
+		data.Port = 5432
+		data.Tags = []string{"coredns.enabled"}
+		data.Meta = map[string]string{"coredns-acl": "allow private"}
+		client.(*testCatalogClient).services["hostname"] = []*testServiceData{&data}
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		for qtype, expected := range map[uint16][]string{
+			dns.TypeA:    {"CNAME db.internal.example.net.", "A 10.0.0.42"},
+			dns.TypeAAAA: {"CNAME db.internal.example.net."},
+			dns.TypeSRV:  {"SRV 1 1 5432 db.internal.example.net."},
+		} {
+			req := new(dns.Msg)
+			req.SetQuestion("hostname.example.com.", qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.5"})
+			if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			found := []string{}
+			for _, rr := range rec.Msg.Answer {
+				fields := strings.Fields(rr.String())
+				found = append(found, strings.Join(fields[3:], " "))
+			}
+
+			if strings.Join(found, ", ") != strings.Join(expected, ", ") {
+				t.Fatalf("Expected %s answers %v, got %s", dns.TypeToString[qtype], expected, rec.Msg)
+			}
+
+			if len(rec.Msg.Extra) != 0 {
+				t.Fatalf("Expected no glue for hosts, got %v", rec.Msg.Extra)
+			}
+		}
+	})
+
+	t.Run("hostnames take turns", func(t *testing.T) {
+		lookup := DefaultLookup
+		defer func() { DefaultLookup = lookup }()
+		DefaultLookup = func(ctx context.Context, req request.Request, target string, qtype uint16) (*dns.Msg, error) {
+			return new(dns.Msg), nil
+		}
+
+		c, client, _ := NewTestCatalog(false)
+		services := []*testServiceData{}
+		for idx, host := range []string{"db-1.internal.example.net", "db-2.internal.example.net"} {
+			services = append(services, &testServiceData{
+				Address:        fmt.Sprintf("192.168.100.%d", 50+idx),
+				ServiceAddress: host,
+				Port:           5432,
+				Tags:           []string{"coredns.enabled"},
+				Meta:           map[string]string{"coredns-acl": "allow private"},
+			})
+		}
+		client.(*testCatalogClient).services["replicas"] = services
+		if err := c.ReloadAll(); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		seen := map[string]int{}
+		for range 4 {
+			// explaining a query shows the host the next client gets, without taking its turn
+			e, err := c.Explain(context.TODO(), "replicas.example.com", dns.TypeA, &net.IPNet{IP: net.ParseIP("192.168.100.5"), Mask: net.CIDRMask(32, 32)})
+			if err != nil || len(e.Answer) != 1 || len(e.Upstream) != 1 {
+				t.Fatalf("Unexpected explanation: %+v, %v", e, err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("replicas.example.com.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "192.168.100.5"})
+			if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if len(rec.Msg.Answer) != 1 {
+				t.Fatalf("Expected a single CNAME, got %s", rec.Msg)
+			}
+			target := rec.Msg.Answer[0].(*dns.CNAME).Target
+			if e.Upstream[0] != target {
+				t.Fatalf("Expected explanation to look up %s, got %v", target, e.Upstream)
+			}
+			seen[target]++
+		}
+
+		if seen["db-1.internal.example.net."] != 2 || seen["db-2.internal.example.net."] != 2 {
+			t.Fatalf("Expected hosts to take turns, got %v", seen)
+		}
+	})
+}
@@ -4,6 +4,10 @@
 package catalog
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -23,35 +27,122 @@ type KVClient interface {
 	List(prefix string, opts *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
 }
 
-// CreateClient initializes the consul catalog client.
-func CreateClient(scheme, endpoint, token string) (catalog Client, kv KVClient, err error) {
-	cfg := api.DefaultConfig()
-	cfg.Address = endpoint
-	if token != "" {
-		cfg.Token = token
+// HealthClient is implemented by github.com/hashicorp/consul/api.Health.
+type HealthClient interface {
+	Service(service, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error)
+}
+
+// NamespaceClient is implemented by github.com/hashicorp/consul/api.Namespaces.
+type NamespaceClient interface {
+	List(q *api.QueryOptions) ([]*api.Namespace, *api.QueryMeta, error)
+}
+
+// CreateClient initializes the consul catalog client, sending queries to the first of
+// endpoints that is healthy.
+func CreateClient(scheme string, endpoints []string, token string, tlsConfig api.TLSConfig) (catalog Client, kv KVClient, health HealthClient, namespaces NamespaceClient, err error) {
+	clients := make([]*api.Client, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		cfg := api.DefaultConfig()
+		cfg.Address = endpoint
+		// token files are read by the plugin, so they can be read again when rotated
+		cfg.TokenFile = ""
+		if token != "" {
+			cfg.Token = token
+		}
+
+		if scheme == "https" {
+			cfg.Scheme = "https"
+			cfg.TLSConfig = tlsConfig
+		}
+
+		client, clientErr := api.NewClient(cfg)
+		if clientErr != nil {
+			err = clientErr
+			return
+		}
+		clients = append(clients, client)
 	}
 
-	if scheme == "https" {
-		cfg.Scheme = "https"
+	if len(clients) == 0 {
+		err = fmt.Errorf("no consul endpoints given")
+		return
 	}
 
-	client, err := api.NewClient(cfg)
+	pool := NewEndpoints(endpoints, clients)
+	catalog = endpointsCatalog{pool}
+	kv = endpointsKV{pool}
+	health = endpointsHealth{pool}
+	namespaces = endpointsNamespaces{pool}
+	return
+}
+
+// TokenFile holds a consul ACL token read from a file, and reads it again whenever the
+// file changes, so rotated tokens are used by running watches.
+type TokenFile struct {
+	sync.Mutex
+	Path    string
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// NewTokenFile reads a token from path.
+func NewTokenFile(path string) (*TokenFile, error) {
+	f := &TokenFile{Path: path}
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
+// Token returns the current token, or the last one read if the file can't be read.
+func (f *TokenFile) Token() string {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.refresh(); err != nil {
+		Log.Warningf("Could not read token from %s, using last known token: %s", f.Path, err)
+	}
+	return f.token
+}
+
+// refresh must be called while holding the token file's lock.
+func (f *TokenFile) refresh() error {
+	info, err := os.Stat(f.Path)
 	if err != nil {
-		return
+		return err
 	}
 
-	catalog = client.Catalog()
-	kv = client.KV()
-	return
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("token file %s is empty", f.Path)
+	}
+
+	if f.token != "" && f.token != token {
+		Log.Infof("Using rotated token from %s", f.Path)
+	}
+	f.token = token
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
 }
 
 // StaticEntry represents a consul value, json encoded.
 type StaticEntry struct {
 	Target    string   `json:"target"`
 	Addresses []string `json:"addresses"`
-	ACL       []string `json:"acl"`
-	Aliases   []string `json:"aliases"`
+	// AddressesByZone replace Addresses for clients in the acl zone they're keyed by.
+	AddressesByZone map[string][]string `json:"addresses_by_zone"`
+	ACL             []string            `json:"acl"`
+	Aliases         []string            `json:"aliases"`
 }
 
 type StaticEntries map[string]*StaticEntry
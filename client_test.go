@@ -0,0 +1,318 @@
+// Copyright © 2022 Roberto Hidalgo <coredns-consul@un.rob.mx>
+// SPDX-License-Identifier: Apache-2.0
+package catalog_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/unRob/coredns-consul"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer := &testCert{cert: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %s", err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writeCert(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatalf("could not write certificate: %s", err)
+	}
+	return path
+}
+
+func (c *testCert) writeKey(t *testing.T, dir, name string) string {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %s", err)
+	}
+
+	path := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("could not write key: %s", err)
+	}
+	return path
+}
+
+func TestCreateClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "consul.test"},
+		DNSNames:    []string{"consul.test"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "coredns"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+
+	caDir := t.TempDir()
+	caFile := ca.writeCert(t, caDir, "ca")
+	certFile := client.writeCert(t, dir, "client")
+	keyFile := client.writeKey(t, dir, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/catalog/services" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		_, _ = w.Write([]byte(`{"git": ["coredns.enabled"]}`))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	endpoint := srv.Listener.Addr().String()
+
+	tests := []struct {
+		Name        string
+		TLS         api.TLSConfig
+		ShouldError bool
+	}{
+		{
+			Name: "mutual tls",
+			TLS: api.TLSConfig{
+				Address:  "consul.test",
+				CAFile:   caFile,
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			},
+		},
+		{
+			Name: "ca path",
+			TLS: api.TLSConfig{
+				Address:  "consul.test",
+				CAPath:   caDir,
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			},
+		},
+		{
+			Name: "skip verify",
+			TLS: api.TLSConfig{
+				CertFile:           certFile,
+				KeyFile:            keyFile,
+				InsecureSkipVerify: true,
+			},
+		},
+		{
+			Name: "missing client certificate",
+			TLS: api.TLSConfig{
+				Address: "consul.test",
+				CAFile:  caFile,
+			},
+			ShouldError: true,
+		},
+		{
+			Name: "unknown ca",
+			TLS: api.TLSConfig{
+				Address:  "consul.test",
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			},
+			ShouldError: true,
+		},
+		{
+			Name: "wrong server name",
+			TLS: api.TLSConfig{
+				Address:  "nomad.test",
+				CAFile:   caFile,
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			},
+			ShouldError: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			catalog, _, _, _, err := CreateClient("https", []string{endpoint}, "", tst.TLS)
+			if err != nil {
+				t.Fatalf("could not create client: %s", err)
+			}
+
+			services, meta, err := catalog.Services(nil)
+			if tst.ShouldError {
+				if err == nil {
+					t.Fatalf("Expected errors, but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+
+			if _, ok := services["git"]; !ok || meta.LastIndex != 7 {
+				t.Fatalf("Unexpected services: %v at index %d", services, meta.LastIndex)
+			}
+		})
+	}
+
+	t.Run("missing ca file", func(t *testing.T) {
+		_, _, _, _, err := CreateClient("https", []string{endpoint}, "", api.TLSConfig{CAFile: filepath.Join(dir, "missing.pem")})
+		if err == nil {
+			t.Fatalf("Expected errors, but got none")
+		}
+	})
+}
+
+func TestCreateClientFailover(t *testing.T) {
+	newAgent := func(index string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/status/leader":
+				_, _ = w.Write([]byte(`"10.0.0.1:8300"`))
+			case "/v1/catalog/services":
+				w.Header().Set("X-Consul-Index", index)
+				_, _ = w.Write([]byte(`{"git": ["coredns.enabled"]}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+
+	down := newAgent("1")
+	down.Close()
+	up := newAgent("8")
+	defer up.Close()
+
+	endpoints := []string{down.Listener.Addr().String(), up.Listener.Addr().String()}
+	catalog, _, _, _, err := CreateClient("http", endpoints, "", api.TLSConfig{})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+
+	if _, _, err := catalog.Services(nil); err == nil {
+		t.Fatalf("Expected the first endpoint to fail")
+	}
+
+	services, meta, err := catalog.Services(nil)
+	if err != nil {
+		t.Fatalf("Expected the second endpoint to answer, got: %s", err)
+	}
+
+	if _, ok := services["git"]; !ok || meta.LastIndex != 8 {
+		t.Fatalf("Unexpected services: %v at index %d", services, meta.LastIndex)
+	}
+
+	if active := testutil.ToFloat64(EndpointActive.WithLabelValues("", "", endpoints[1])); active != 1 {
+		t.Fatalf("Expected %s to be reported as active, got %v", endpoints[1], active)
+	}
+
+	if active := testutil.ToFloat64(EndpointActive.WithLabelValues("", "", endpoints[0])); active != 0 {
+		t.Fatalf("Expected %s to be reported as inactive, got %v", endpoints[0], active)
+	}
+}
+
+func TestTokenFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first-token\n"), 0o600); err != nil {
+		t.Fatalf("could not write token: %s", err)
+	}
+
+	tokens, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatalf("could not read token: %s", err)
+	}
+
+	c, client, _ := NewTestCatalog(false)
+	c.TokenFile = tokens
+	testclient := client.(*testCatalogClient)
+
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if testclient.LastOptions.Token != "first-token" {
+		t.Fatalf("Expected first-token to be used, got %q", testclient.LastOptions.Token)
+	}
+
+	if err := os.WriteFile(path, []byte("second-token\n"), 0o600); err != nil {
+		t.Fatalf("could not write token: %s", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("could not touch token: %s", err)
+	}
+
+	testclient.Touch("git")
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if testclient.LastOptions.Token != "second-token" {
+		t.Fatalf("Expected rotated token to be used, got %q", testclient.LastOptions.Token)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("could not remove token: %s", err)
+	}
+
+	if token := tokens.Token(); token != "second-token" {
+		t.Fatalf("Expected last known token after removal, got %q", token)
+	}
+}
@@ -3,8 +3,16 @@
 package catalog_test
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	. "github.com/unRob/coredns-consul"
 )
 
@@ -77,6 +85,108 @@ func TestFetchStaticServicePrefix(t *testing.T) {
 	}
 }
 
+func TestWatchACLZones(t *testing.T) {
+	c, _, kv := NewTestCatalog(false, NewWatch(&WatchACLZones{Key: "acl/zones"}), NewWatch(&WatchKVPath{Key: "office/path"}))
+	c.ZonesPath = "acl/zones"
+	keys := kv.(*testKVClient).Keys
+	keys["office/path"] = &api.KVPair{
+		Key:   "office/path",
+		Value: []byte(`{"printer": {"addresses": ["10.10.0.9"], "acl": ["allow office, lab", "deny public"]}}`),
+	}
+
+	setZones := func(zones string) error {
+		keys["acl/zones"] = &api.KVPair{Key: "acl/zones", Value: []byte(zones)}
+		return c.ReloadAll()
+	}
+
+	respondsTo := func(t *testing.T, expected map[string]bool) {
+		t.Helper()
+		svc := c.ServiceFor("printer")
+		if svc == nil {
+			t.Fatalf("Service printer not found, got: %+v", c.Services())
+		}
+
+		for ip, allowed := range expected {
+			if svc.RespondsTo(net.ParseIP(ip)) != allowed {
+				t.Fatalf("Expected printer to respond to %s: %v, got ACL %+v", ip, allowed, svc.ACL)
+			}
+		}
+	}
+
+	t.Run("zones from kv", func(t *testing.T) {
+		if err := setZones(`{"office": ["10.10.0.0/16"]}`); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		respondsTo(t, map[string]bool{"10.10.1.1": true, "10.20.1.1": false, "10.30.1.1": false})
+	})
+
+	t.Run("changed zones", func(t *testing.T) {
+		if err := setZones(`{"office": ["10.20.0.0/16"], "lab": ["10.30.0.0/16"]}`); err != nil {
+			t.Fatalf("could not fetch services: %s", err)
+		}
+
+		respondsTo(t, map[string]bool{"10.10.1.1": false, "10.20.1.1": true, "10.30.1.1": true})
+	})
+
+	t.Run("invalid json keeps zones", func(t *testing.T) {
+		if err := setZones(`{"office": `); err == nil {
+			t.Fatalf("Expected invalid zones to fail")
+		}
+
+		respondsTo(t, map[string]bool{"10.10.1.1": false, "10.20.1.1": true, "10.30.1.1": true})
+	})
+
+	t.Run("invalid range keeps zones", func(t *testing.T) {
+		if err := setZones(`{"office": ["10.10.0.0/16"], "lab": ["10.30.0.0"]}`); err == nil {
+			t.Fatalf("Expected invalid zones to fail")
+		}
+
+		respondsTo(t, map[string]bool{"10.10.1.1": false, "10.20.1.1": true, "10.30.1.1": true})
+	})
+}
+
+func TestWatchACLZonesStartup(t *testing.T) {
+	printer := &api.KVPair{
+		Key:   "office/path",
+		Value: []byte(`{"printer": {"addresses": ["10.10.0.9"], "acl": ["allow office, private", "deny public"]}}`),
+	}
+
+	for name, zones := range map[string]*api.KVPair{
+		"missing key":  nil,
+		"invalid json": {Key: "acl/zones", Value: []byte(`{"office": `)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, _, kv := NewTestCatalog(false, NewWatch(&WatchACLZones{Key: "acl/zones"}), NewWatch(&WatchKVPath{Key: "office/path"}))
+			c.ZonesPath = "acl/zones"
+			keys := kv.(*testKVClient).Keys
+			keys["office/path"] = printer
+			if zones != nil {
+				keys["acl/zones"] = zones
+			}
+
+			if err := c.ReloadAll(); err != nil {
+				t.Fatalf("could not fetch services: %s", err)
+			}
+
+			if !c.Ready() {
+				t.Fatalf("Expected catalog to be ready, pending: %v", c.Pending())
+			}
+
+			svc := c.ServiceFor("printer")
+			if svc == nil {
+				t.Fatalf("Service printer not found, got: %+v", c.Services())
+			}
+
+			for ip, allowed := range map[string]bool{"192.168.100.10": true, "10.10.1.1": false} {
+				if svc.RespondsTo(net.ParseIP(ip)) != allowed {
+					t.Fatalf("Expected printer to respond to %s: %v, got ACL %+v", ip, allowed, svc.ACL)
+				}
+			}
+		})
+	}
+}
+
 func TestFetchServices(t *testing.T) {
 	c, client, _ := NewTestCatalog(true)
 
@@ -130,3 +240,326 @@ func TestFetchServices(t *testing.T) {
 		t.Fatalf("Unexpected number of services after update: %d", newCount)
 	}
 }
+
+func TestFetchHealthyServices(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Status   string
+		Fallback bool
+		Critical bool
+		Expected []string
+	}{
+		{
+			Name:     "passing only",
+			Status:   api.HealthPassing,
+			Expected: []string{"192.168.100.3"},
+		},
+		{
+			Name:     "passing and warning",
+			Status:   api.HealthWarning,
+			Expected: []string{"192.168.100.3", "192.168.100.4"},
+		},
+		{
+			Name:     "no healthy instances",
+			Status:   api.HealthPassing,
+			Critical: true,
+			Expected: []string{},
+		},
+		{
+			Name:     "no healthy instances with fallback",
+			Status:   api.HealthPassing,
+			Fallback: true,
+			Critical: true,
+			Expected: []string{"192.168.100.3", "192.168.100.4"},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			c, client, _ := NewTestCatalog(false)
+			c.HealthStatus = tst.Status
+			c.HealthFallback = tst.Fallback
+
+			if tst.Critical {
+				for _, instance := range client.(*testCatalogClient).services["git"] {
+					instance.Status = api.HealthCritical
+				}
+			}
+
+			if err := c.ReloadAll(); err != nil {
+				t.Fatalf("could not fetch services: %s", err)
+			}
+
+			svc := c.ServiceFor("git")
+			if svc == nil {
+				t.Fatalf("Service git not found, got: %+v", c.Services())
+			}
+
+			addresses := []string{}
+			for _, addr := range svc.Addresses {
+				addresses = append(addresses, addr.String())
+			}
+
+			if fmt.Sprint(addresses) != fmt.Sprint(tst.Expected) {
+				t.Fatalf("Expected addresses %v, got %v", tst.Expected, addresses)
+			}
+
+			if len(svc.ACL) == 0 {
+				t.Fatalf("Expected ACL to be parsed for git")
+			}
+		})
+	}
+}
+
+func TestWatchServiceChanges(t *testing.T) {
+	c, client, _ := NewTestCatalog(true)
+	testclient := client.(*testCatalogClient)
+
+	watchFor := func(name string) *Watch {
+		for _, src := range c.Sources {
+			if src.Name() == "consul catalog service "+name {
+				return src
+			}
+		}
+		return nil
+	}
+
+	gitWatch := watchFor("git")
+	nomadWatch := watchFor("nomad")
+	if gitWatch == nil || nomadWatch == nil {
+		t.Fatalf("Expected watches for git and nomad, got %d sources", len(c.Sources))
+	}
+	gitIndex := gitWatch.LastIndex
+	nomadIndex := nomadWatch.LastIndex
+
+	testclient.services["git"][0].Address = "192.168.100.30"
+	testclient.Touch("git")
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if gitWatch.LastIndex == gitIndex {
+		t.Fatalf("Expected git index to change")
+	}
+
+	if nomadWatch.LastIndex != nomadIndex {
+		t.Fatalf("Expected nomad index to stay at %d, got %d", nomadIndex, nomadWatch.LastIndex)
+	}
+
+	if addr := c.ServiceFor("git").Addresses[0].String(); addr != "192.168.100.30" {
+		t.Fatalf("Expected updated address for git, got %s", addr)
+	}
+
+	for _, name := range []string{"git", "nomad", "traefik"} {
+		if calls := testclient.calls[name]; calls != 2 {
+			t.Fatalf("Expected %s to be fetched once per reload, got %d calls", name, calls)
+		}
+	}
+
+	testclient.Retag("git")
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if watchFor("git") != nil {
+		t.Fatalf("Expected watch for git to be stopped after untagging")
+	}
+
+	if svc := c.ServiceFor("git"); svc != nil {
+		t.Fatalf("Expected git to stop being served, got %+v", svc)
+	}
+
+	testclient.Retag("git", "coredns.enabled")
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	if watchFor("git") == nil || c.ServiceFor("git") == nil {
+		t.Fatalf("Expected git to be served after tagging")
+	}
+}
+
+func TestCatalogTagMatching(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Tags     []string
+		Match    string
+		Expected []string
+	}{
+		{
+			Name:     "single tag",
+			Tags:     []string{"coredns.enabled"},
+			Match:    TagMatchAny,
+			Expected: []string{"git", "nomad", "traefik"},
+		},
+		{
+			Name:     "any of several tags",
+			Tags:     []string{"traefik.enable=true", "coredns.enabled"},
+			Match:    TagMatchAny,
+			Expected: []string{"git", "nomad", "traefik"},
+		},
+		{
+			Name:     "all of several tags",
+			Tags:     []string{"coredns.enabled", "traefik.enable=true"},
+			Match:    TagMatchAll,
+			Expected: []string{"nomad", "traefik"},
+		},
+		{
+			Name:     "negated tag",
+			Tags:     []string{"coredns.enabled", "!traefik.enable=true"},
+			Match:    TagMatchAny,
+			Expected: []string{"git"},
+		},
+		{
+			Name:     "only negated tags",
+			Tags:     []string{"!traefik.enable=true"},
+			Match:    TagMatchAll,
+			Expected: []string{"git", "nomad-client"},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			c, _, _ := NewTestCatalog(false)
+			c.ACLTag = ""
+			c.Sources = []*Watch{NewWatch(&WatchConsulCatalog{Tags: tst.Tags, Match: tst.Match})}
+
+			if err := c.ReloadAll(); err != nil {
+				t.Fatalf("could not fetch services: %s", err)
+			}
+
+			found := []string{}
+			for name := range c.Services() {
+				found = append(found, name)
+			}
+			sort.Strings(found)
+
+			if fmt.Sprint(found) != fmt.Sprint(tst.Expected) {
+				t.Fatalf("Expected services %v, got %v", tst.Expected, found)
+			}
+		})
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for range 10 {
+		c, client, _ := NewTestCatalog(false)
+		client.(*testCatalogClient).Blocking = true
+		c.Start(context.Background())
+
+		deadline := time.Now().Add(5 * time.Second)
+		for c.ServiceFor("git") == nil || c.ServiceFor("nomad") == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for services, got: %+v", c.Services())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		c.Stop()
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("Expected at most %d goroutines after restarts, got %d", before, after)
+	}
+}
+
+func TestQueryConsistency(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Consistency string
+		MaxStale    time.Duration
+		UseCache    bool
+		LastContact time.Duration
+		Expected    api.QueryOptions
+		Contact     float64
+	}{
+		{
+			Name:        "default",
+			Consistency: ConsistencyDefault,
+			LastContact: 5 * time.Second,
+			Expected:    api.QueryOptions{},
+		},
+		{
+			Name:        "consistent",
+			Consistency: ConsistencyConsistent,
+			Expected:    api.QueryOptions{RequireConsistent: true},
+		},
+		{
+			Name:        "stale",
+			Consistency: ConsistencyStale,
+			LastContact: 2 * time.Second,
+			Expected:    api.QueryOptions{AllowStale: true},
+			Contact:     2,
+		},
+		{
+			Name:        "stale within bounds",
+			Consistency: ConsistencyStale,
+			MaxStale:    10 * time.Second,
+			LastContact: 2 * time.Second,
+			Expected:    api.QueryOptions{AllowStale: true},
+			Contact:     2,
+		},
+		{
+			Name:        "too stale",
+			Consistency: ConsistencyStale,
+			MaxStale:    time.Second,
+			LastContact: 5 * time.Second,
+			Expected:    api.QueryOptions{},
+		},
+		{
+			Name:        "cached",
+			Consistency: ConsistencyStale,
+			MaxStale:    10 * time.Second,
+			UseCache:    true,
+			Expected:    api.QueryOptions{AllowStale: true, UseCache: true, MaxAge: 10 * time.Second},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			c, client, _ := NewTestCatalog(false)
+			c.Consistency = tst.Consistency
+			c.MaxStale = tst.MaxStale
+			c.UseCache = tst.UseCache
+			testclient := client.(*testCatalogClient)
+			testclient.LastContact = tst.LastContact
+
+			if err := c.ReloadAll(); err != nil {
+				t.Fatalf("could not fetch services: %s", err)
+			}
+
+			if svc := c.ServiceFor("git"); svc == nil || len(svc.Addresses) != 2 {
+				t.Fatalf("Unexpected service for git: %+v", svc)
+			}
+
+			opts := testclient.LastOptions
+			if opts.AllowStale != tst.Expected.AllowStale || opts.RequireConsistent != tst.Expected.RequireConsistent {
+				t.Fatalf("Unexpected consistency, stale: %v consistent: %v", opts.AllowStale, opts.RequireConsistent)
+			}
+
+			if opts.UseCache != tst.Expected.UseCache || opts.MaxAge != tst.Expected.MaxAge {
+				t.Fatalf("Unexpected cache options, cached: %v max age: %v", opts.UseCache, opts.MaxAge)
+			}
+
+			var source *Watch
+			for _, src := range c.Sources {
+				if src.Name() == "consul catalog service git" {
+					source = src
+				}
+			}
+			if source == nil {
+				t.Fatalf("No watch found for git")
+			}
+
+			if contact := testutil.ToFloat64(WatchLastContact.WithLabelValues("services")); contact != tst.Contact {
+				t.Fatalf("Unexpected last contact metric: %v", contact)
+			}
+
+			if leader := testutil.ToFloat64(WatchKnownLeader.WithLabelValues("services")); leader != 1 {
+				t.Fatalf("Unexpected known leader metric: %v", leader)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright © 2022 Roberto Hidalgo <coredns-consul@un.rob.mx>
+// SPDX-License-Identifier: Apache-2.0
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// DebugACL is an ACL rule as served by the debug endpoint.
+type DebugACL struct {
+	Action   string   `json:"action"`
+	Zone     string   `json:"zone"`
+	Networks []string `json:"networks"`
+	Types    []string `json:"types,omitempty"`
+	Window   string   `json:"window,omitempty"`
+}
+
+func debugACL(acl *ServiceACL) DebugACL {
+	rule := DebugACL{Action: acl.Action, Zone: acl.Zone, Networks: []string{}}
+	for _, network := range acl.Networks {
+		rule.Networks = append(rule.Networks, network.String())
+	}
+	for _, qtype := range acl.Types {
+		rule.Types = append(rule.Types, dns.TypeToString[qtype])
+	}
+	if acl.Window != nil {
+		rule.Window = acl.Window.String()
+	}
+	return rule
+}
+
+// DebugInstance is a service instance as served by the debug endpoint.
+type DebugInstance struct {
+	ID            string            `json:"id"`
+	Node          string            `json:"node"`
+	Address       string            `json:"address,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	Port          int               `json:"port"`
+	ZoneAddresses map[string]string `json:"addresses_by_zone,omitempty"`
+}
+
+// DebugService is a service as served by the debug endpoint.
+type DebugService struct {
+	Target        string              `json:"target"`
+	Addresses     []string            `json:"addresses"`
+	Hosts         []string            `json:"hosts,omitempty"`
+	ZoneAddresses map[string][]string `json:"addresses_by_zone,omitempty"`
+	ACL           []DebugACL          `json:"acl"`
+	Aliases       []string            `json:"aliases,omitempty"`
+	AliasOf       string              `json:"alias_of,omitempty"`
+	Instances     []DebugInstance     `json:"instances,omitempty"`
+	Source        string              `json:"source"`
+}
+
+// DebugWatch is the state of a watch as served by the debug endpoint.
+type DebugWatch struct {
+	Name      string     `json:"name"`
+	LastIndex uint64     `json:"last_index"`
+	Refreshed *time.Time `json:"refreshed,omitempty"`
+	Ready     bool       `json:"ready"`
+}
+
+// DebugState is everything served by the debug endpoint.
+type DebugState struct {
+	Services map[string]DebugService `json:"services"`
+	Watches  []DebugWatch            `json:"watches"`
+}
+
+// DebugState returns the services being served and the state of every watch.
+func (c *Catalog) DebugState() DebugState {
+	services := c.Services()
+	state := DebugState{Services: map[string]DebugService{}, Watches: []DebugWatch{}}
+
+	aliases := map[string][]string{}
+	for name, svc := range services {
+		if svc.AliasOf != "" {
+			aliases[svc.AliasOf] = append(aliases[svc.AliasOf], name)
+		}
+	}
+
+	for name, svc := range services {
+		debug := DebugService{
+			Target:    svc.Target,
+			Addresses: []string{},
+			ACL:       []DebugACL{},
+			Hosts:     svc.Hosts,
+			AliasOf:   svc.AliasOf,
+			Source:    svc.Source,
+		}
+
+		for _, addr := range svc.Addresses {
+			debug.Addresses = append(debug.Addresses, addr.String())
+		}
+
+		for zone, addrs := range svc.ZoneAddresses {
+			if debug.ZoneAddresses == nil {
+				debug.ZoneAddresses = map[string][]string{}
+			}
+			debug.ZoneAddresses[zone] = []string{}
+			for _, addr := range addrs {
+				debug.ZoneAddresses[zone] = append(debug.ZoneAddresses[zone], addr.String())
+			}
+		}
+
+		for _, acl := range svc.ACL {
+			debug.ACL = append(debug.ACL, debugACL(acl))
+		}
+
+		for _, instance := range svc.Instances {
+			debugInstance := DebugInstance{
+				ID:   instance.ID,
+				Node: instance.Node,
+				Host: instance.Host,
+				Port: instance.Port,
+			}
+			if instance.Address != nil {
+				debugInstance.Address = instance.Address.String()
+			}
+			for zone, addr := range instance.ZoneAddresses {
+				if debugInstance.ZoneAddresses == nil {
+					debugInstance.ZoneAddresses = map[string]string{}
+				}
+				debugInstance.ZoneAddresses[zone] = addr.String()
+			}
+			debug.Instances = append(debug.Instances, debugInstance)
+		}
+
+		if svc.AliasOf == "" {
+			debug.Aliases = aliases[name]
+			sort.Strings(debug.Aliases)
+		}
+
+		state.Services[name] = debug
+	}
+
+	c.RLock()
+	sources := c.Sources
+	c.RUnlock()
+	for _, src := range sources {
+		watch := DebugWatch{Name: src.Name(), Ready: src.Ready()}
+		src.RLock()
+		watch.LastIndex = src.LastIndex
+		if !src.refreshed.IsZero() {
+			refreshed := src.refreshed
+			watch.Refreshed = &refreshed
+		}
+		src.RUnlock()
+		state.Watches = append(state.Watches, watch)
+	}
+
+	return state
+}
+
+// Explanation is why a client gets, or is denied, an answer for a name.
+type Explanation struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Client   string    `json:"client"`
+	Service  string    `json:"service,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Allowed  bool      `json:"allowed"`
+	Rule     *DebugACL `json:"rule,omitempty"`
+	Network  string    `json:"network,omitempty"`
+	Reason   string    `json:"reason"`
+	Source   string    `json:"source,omitempty"`
+	Answer   []string  `json:"answer"`
+	Upstream []string  `json:"upstream,omitempty"`
+}
+
+// explainKey is the context key of the explainLookups of a request simulated by Explain.
+type explainKey struct{}
+
+// explainLookups holds the names a request simulated by Explain would look up upstream.
+type explainLookups struct {
+	names []string
+}
+
+// Explain returns the service, ACL rule and answer a client would get for a query,
+// without counting it in metrics or passing it to the next plugin. Upstream lookups are
+// reported instead of made, so Answer lacks the records they would add.
+func (c *Catalog) Explain(ctx context.Context, qname string, qtype uint16, client *net.IPNet) (*Explanation, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(qname), qtype)
+	state := request.Request{W: &explainWriter{client: client.IP}, Req: req, Zone: c.Zone}
+
+	e := &Explanation{Name: state.QName(), Type: state.Type(), Client: client.String(), Answer: []string{}}
+	name, zone := c.queryName(state)
+	svc, instance := c.lookup(name)
+	if svc == nil {
+		e.Reason = fmt.Sprintf("no service named %s, passed to the next plugin", name)
+		return e, nil
+	}
+
+	e.Service = svc.Name
+	if instance != nil {
+		e.Instance = instance.Node
+	}
+
+	allowed, rule, network := c.allows(svc, client, qtype)
+	e.Allowed = allowed
+	switch {
+	case !c.enforcesACL():
+		e.Reason = "no acl zones configured"
+	case rule == nil:
+		e.Reason = fmt.Sprintf("default %s, no rule matched", c.ACLDefault)
+	case allowed:
+		e.Reason = fmt.Sprintf("allowed by rule %s %s", rule.Action, rule.Zone)
+	default:
+		e.Reason = fmt.Sprintf("denied by rule %s %s", rule.Action, rule.Zone)
+	}
+
+	if rule != nil {
+		debug := debugACL(rule)
+		e.Rule = &debug
+		e.Network = network.String()
+	}
+
+	if !e.Allowed {
+		if c.ACLDenyResponse == DenyNext {
+			e.Reason += ", passed to the next plugin"
+		} else {
+			e.Reason += ", answered with " + c.ACLDenyResponse
+		}
+		return e, nil
+	}
+
+	lookups := &explainLookups{}
+	m, source, err := c.answer(context.WithValue(ctx, explainKey{}, lookups), state, svc, instance, client, zone)
+	if err != nil {
+		return nil, err
+	}
+	e.Upstream = lookups.names
+
+	e.Source = source
+	switch {
+	case source == "":
+		e.Reason += fmt.Sprintf(", no %s records", e.Type)
+	case len(e.Upstream) > 0:
+		e.Reason += ", answered after looking up " + strings.Join(e.Upstream, ", ") + " upstream"
+	}
+	for _, rr := range m.Answer {
+		e.Answer = append(e.Answer, rr.String())
+	}
+	return e, nil
+}
+
+// explainWriter is a dns.ResponseWriter for requests simulated by Explain.
+type explainWriter struct {
+	client net.IP
+}
+
+func (w *explainWriter) LocalAddr() net.Addr           { return &net.UDPAddr{IP: net.IPv4zero, Port: 53} }
+func (w *explainWriter) RemoteAddr() net.Addr          { return &net.UDPAddr{IP: w.client, Port: 53} }
+func (w *explainWriter) WriteMsg(*dns.Msg) error       { return nil }
+func (w *explainWriter) Write(buf []byte) (int, error) { return len(buf), nil }
+func (w *explainWriter) Close() error                  { return nil }
+func (w *explainWriter) TsigStatus() error             { return nil }
+func (w *explainWriter) TsigTimersOnly(bool)           {}
+func (w *explainWriter) Hijack()                       {}
+
+// DebugHandler returns the handler for the debug endpoint, serving DebugState as json
+// at `/services`, and an Explanation for the `name`, `client` (an IP address or CIDR
+// range) and optional `type` query parameters at `/explain`.
+func (c *Catalog) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.DebugState()); err != nil {
+			Log.Warningf("Could not encode debug state: %s", err)
+		}
+	})
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		name := query.Get("name")
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		var client *net.IPNet
+		if ip := net.ParseIP(query.Get("client")); ip != nil {
+			client = hostNetwork(ip)
+		} else if _, subnet, err := net.ParseCIDR(query.Get("client")); err == nil {
+			client = subnet
+		} else {
+			http.Error(w, fmt.Sprintf("could not parse client ip or subnet %q", query.Get("client")), http.StatusBadRequest)
+			return
+		}
+
+		qtype := dns.TypeA
+		if typeName := query.Get("type"); typeName != "" {
+			parsed, ok := dns.StringToType[strings.ToUpper(typeName)]
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown query type %q", typeName), http.StatusBadRequest)
+				return
+			}
+			qtype = parsed
+		}
+
+		explanation, err := c.Explain(r.Context(), name, qtype, client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(explanation); err != nil {
+			Log.Warningf("Could not encode explanation: %s", err)
+		}
+	})
+	return mux
+}
+
+// debugServer serves a catalog's debug endpoint over HTTP.
+type debugServer struct {
+	addr    string
+	catalog *Catalog
+	server  *http.Server
+}
+
+func (d *debugServer) start() error {
+	ln, err := reuseport.Listen("tcp", d.addr)
+	if err != nil {
+		return err
+	}
+
+	d.server = &http.Server{
+		Handler:           d.catalog.DebugHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	Log.Infof("Serving debug endpoint at %s", d.addr)
+	go func(server *http.Server) {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Log.Errorf("Could not serve debug endpoint at %s: %s", d.addr, err)
+		}
+	}(d.server)
+	return nil
+}
+
+func (d *debugServer) stop() error {
+	if d.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.server.Shutdown(ctx)
+	d.server = nil
+	return err
+}
@@ -0,0 +1,198 @@
+// Copyright © 2022 Roberto Hidalgo <coredns-consul@un.rob.mx>
+// SPDX-License-Identifier: Apache-2.0
+package catalog_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	. "github.com/unRob/coredns-consul"
+)
+
+func TestDebugHandler(t *testing.T) {
+	src := NewWatch(&WatchKVPath{Key: "static/path"})
+	c, _, kv := NewTestCatalog(false, src)
+	kv.(*testKVClient).Keys["static/path"] = &api.KVPair{Key: "static/path", Value: staticServices()}
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	srv := httptest.NewServer(c.DebugHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/services")
+	if err != nil {
+		t.Fatalf("could not query debug endpoint: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	state := DebugState{}
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		t.Fatalf("could not decode debug state: %s", err)
+	}
+
+	git, ok := state.Services["git"]
+	if !ok {
+		t.Fatalf("Expected git to be served, got %+v", state.Services)
+	}
+
+	if fmt.Sprint(git.Addresses) != "[192.168.100.3 192.168.100.4]" || git.Source != "consul catalog service git" {
+		t.Fatalf("Unexpected git service: %+v", git)
+	}
+
+	if len(git.ACL) != 2 || git.ACL[0].Action != "deny" || git.ACL[0].Zone != "guest" || fmt.Sprint(git.ACL[0].Networks) != "[192.168.1.0/24]" {
+		t.Fatalf("Unexpected git ACL: %+v", git.ACL)
+	}
+
+	if alias := state.Services["alias"]; fmt.Sprint(alias.Aliases) != "[*.alias]" || alias.Source != src.Name() {
+		t.Fatalf("Unexpected alias service: %+v", alias)
+	}
+
+	if aliased := state.Services["*.alias"]; aliased.AliasOf != "alias" {
+		t.Fatalf("Unexpected aliased service: %+v", aliased)
+	}
+
+	if len(state.Watches) != len(c.Sources) {
+		t.Fatalf("Expected %d watches, got %+v", len(c.Sources), state.Watches)
+	}
+
+	for _, watch := range state.Watches {
+		if !watch.Ready || watch.LastIndex == 0 || watch.Refreshed == nil {
+			t.Fatalf("Unexpected watch state: %+v", watch)
+		}
+	}
+
+	if res, err := http.Post(srv.URL+"/services", "application/json", nil); err != nil || res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected POST to be rejected, got %v (%v)", res, err)
+	}
+}
+
+func TestDebugExplain(t *testing.T) {
+	c, _, kv := NewTestCatalog(false, NewWatch(&WatchKVPath{Key: "static/path"}))
+	kv.(*testKVClient).Keys["static/path"] = &api.KVPair{Key: "static/path", Value: staticServices()}
+	if err := c.ReloadAll(); err != nil {
+		t.Fatalf("could not fetch services: %s", err)
+	}
+
+	srv := httptest.NewServer(c.DebugHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		query    string
+		status   int
+		service  string
+		allowed  bool
+		network  string
+		reason   string
+		answers  int
+		expected string
+		upstream string
+	}{
+		{
+			query:   "name=git.example.com&client=192.168.1.1",
+			status:  http.StatusOK,
+			service: "git",
+			network: "192.168.1.0/24",
+			reason:  "denied by rule deny guest, passed to the next plugin",
+		},
+		{
+			query:   "name=nomad.example.com&client=192.168.1.1",
+			status:  http.StatusOK,
+			service: "nomad",
+			reason:  "default deny, no rule matched, passed to the next plugin",
+		},
+		{
+			query:    "name=git.example.com&client=10.42.0.1",
+			status:   http.StatusOK,
+			service:  "git",
+			allowed:  true,
+			network:  "0.0.0.0/0",
+			reason:   "allowed by rule allow public",
+			answers:  2,
+			expected: "git.example.com.\t300\tIN\tA\t192.168.100.3",
+		},
+		{
+			query:    "name=_git._tcp.example.com&client=192.168.100.42&type=srv",
+			status:   http.StatusOK,
+			service:  "git",
+			allowed:  true,
+			network:  "0.0.0.0/0",
+			reason:   "allowed by rule allow public",
+			answers:  2,
+			expected: "_git._tcp.example.com.\t300\tIN\tSRV\t1 1 3000 node-192.168.100.3.git.example.com.",
+		},
+		{
+			query:   "name=dual-stack.example.com&client=192.168.100.42&type=TXT",
+			status:  http.StatusOK,
+			service: "dual-stack",
+			allowed: true,
+			network: "192.168.100.0/24",
+			reason:  "allowed by rule allow private, no TXT records",
+		},
+		{
+			query:    "name=upstream.example.com&client=192.168.100.42",
+			status:   http.StatusOK,
+			service:  "upstream",
+			allowed:  true,
+			network:  "192.168.100.0/24",
+			reason:   "allowed by rule allow private, answered after looking up external.service.consul upstream",
+			upstream: "[external.service.consul]",
+		},
+		{
+			query:  "name=does-not-exist.example.com&client=192.168.100.42",
+			status: http.StatusOK,
+			reason: "no service named does-not-exist, passed to the next plugin",
+		},
+		{
+			query:  "name=git.example.com&client=not-an-ip",
+			status: http.StatusBadRequest,
+		},
+		{
+			query:  "name=git.example.com&client=192.168.100.42&type=NOPE",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/explain?" + tc.query)
+			if err != nil {
+				t.Fatalf("could not query debug endpoint: %s", err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, got %d", tc.status, res.StatusCode)
+			}
+
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			e := Explanation{}
+			if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+				t.Fatalf("could not decode explanation: %s", err)
+			}
+
+			if e.Service != tc.service || e.Allowed != tc.allowed || e.Network != tc.network || e.Reason != tc.reason {
+				t.Fatalf("Unexpected explanation: %+v", e)
+			}
+
+			if len(e.Answer) != tc.answers || (tc.expected != "" && e.Answer[0] != tc.expected) {
+				t.Fatalf("Unexpected answer: %v", e.Answer)
+			}
+
+			if tc.upstream != "" && fmt.Sprint(e.Upstream) != tc.upstream {
+				t.Fatalf("Expected %s to be looked up upstream, got %v", tc.upstream, e.Upstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright © 2022 Roberto Hidalgo <coredns-consul@un.rob.mx>
+// SPDX-License-Identifier: Apache-2.0
+package catalog
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+var endpointProbeTimeout = 2 * time.Second
+
+// endpointFailbackInterval is how often the first endpoint is probed while queries are
+// sent to another one.
+var endpointFailbackInterval = 30 * time.Second
+
+// Endpoints holds a consul client for each configured endpoint, and sends queries to the
+// active one until it fails, rotating to the next healthy endpoint then. Queries go back
+// to the first endpoint once it is healthy again.
+type Endpoints struct {
+	sync.Mutex
+	addresses []string
+	clients   []*api.Client
+	active    int
+	server    string
+	zone      string
+	probed    time.Time
+	probing   bool
+	rotating  bool
+}
+
+// NewEndpoints returns the endpoints for addresses, starting with the first one as active.
+func NewEndpoints(addresses []string, clients []*api.Client) *Endpoints {
+	e := &Endpoints{addresses: addresses, clients: clients}
+	e.setActive(0)
+	return e
+}
+
+// Active returns the address queries are currently sent to.
+func (e *Endpoints) Active() string {
+	e.Lock()
+	defer e.Unlock()
+	return e.addresses[e.active]
+}
+
+// current returns the index and client of the active endpoint, probing the first one in
+// the background if it hasn't been for a while.
+func (e *Endpoints) current() (int, *api.Client) {
+	e.Lock()
+	defer e.Unlock()
+	if e.active != 0 && !e.probing && time.Since(e.probed) > endpointFailbackInterval {
+		e.probing = true
+		go e.failback()
+	}
+	return e.active, e.clients[e.active]
+}
+
+// failback makes the first endpoint active again if it is healthy.
+func (e *Endpoints) failback() {
+	healthy := e.healthy(0)
+
+	e.Lock()
+	defer e.Unlock()
+	e.probing = false
+	e.probed = time.Now()
+	if !healthy || e.active == 0 {
+		return
+	}
+	Log.Infof("Consul endpoint %s is healthy again, switching back from %s", e.addresses[0], e.addresses[e.active])
+	e.setActive(0)
+}
+
+// setLabels sets the server and zone the endpoints are reported as used by.
+func (e *Endpoints) setLabels(server, zone string) {
+	e.Lock()
+	defer e.Unlock()
+	for _, addr := range e.addresses {
+		EndpointActive.DeleteLabelValues(e.server, e.zone, addr)
+	}
+	e.server = server
+	e.zone = zone
+	e.setActive(e.active)
+}
+
+// check rotates away from the endpoint at idx if err means it could not answer. Only
+// one query looks for the next endpoint, the rest keep theirs until it is found.
+func (e *Endpoints) check(idx int, err error) {
+	if !isEndpointError(err) || len(e.clients) < 2 {
+		return
+	}
+
+	e.Lock()
+	if e.active != idx || e.rotating {
+		e.Unlock()
+		return
+	}
+	e.rotating = true
+	e.Unlock()
+
+	next := (idx + 1) % len(e.clients)
+	for offset := 1; offset < len(e.clients); offset++ {
+		candidate := (idx + offset) % len(e.clients)
+		if e.healthy(candidate) {
+			next = candidate
+			break
+		}
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.rotating = false
+	if e.active != idx {
+		return
+	}
+	Log.Warningf("Consul endpoint %s failed, switching to %s: %s", e.addresses[idx], e.addresses[next], err)
+	e.probed = time.Now()
+	e.setActive(next)
+}
+
+// healthy returns whether the agent at idx can reach a leader.
+func (e *Endpoints) healthy(idx int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), endpointProbeTimeout)
+	defer cancel()
+	leader, err := e.clients[idx].Status().LeaderWithQueryOptions((&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		Log.Debugf("Consul endpoint %s is unhealthy: %s", e.addresses[idx], err)
+		return false
+	}
+	return leader != ""
+}
+
+// setActive must be called while holding the endpoints' lock.
+func (e *Endpoints) setActive(idx int) {
+	e.active = idx
+	for i, addr := range e.addresses {
+		active := 0.0
+		if i == idx {
+			active = 1
+		}
+		EndpointActive.WithLabelValues(e.server, e.zone, addr).Set(active)
+	}
+}
+
+// isEndpointError returns whether err means the endpoint could not answer a query, as
+// opposed to the query being cancelled or rejected.
+func isEndpointError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var status api.StatusError
+	if errors.As(err, &status) {
+		return status.Code >= 500
+	}
+	return true
+}
+
+type endpointsCatalog struct{ *Endpoints }
+
+func (e endpointsCatalog) Service(service, tag string, qo *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
+	idx, client := e.current()
+	instances, meta, err := client.Catalog().Service(service, tag, qo)
+	e.check(idx, err)
+	return instances, meta, err
+}
+
+func (e endpointsCatalog) Services(qo *api.QueryOptions) (map[string][]string, *api.QueryMeta, error) {
+	idx, client := e.current()
+	services, meta, err := client.Catalog().Services(qo)
+	e.check(idx, err)
+	return services, meta, err
+}
+
+type endpointsKV struct{ *Endpoints }
+
+func (e endpointsKV) Get(key string, qo *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	idx, client := e.current()
+	pair, meta, err := client.KV().Get(key, qo)
+	e.check(idx, err)
+	return pair, meta, err
+}
+
+func (e endpointsKV) List(prefix string, qo *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	idx, client := e.current()
+	pairs, meta, err := client.KV().List(prefix, qo)
+	e.check(idx, err)
+	return pairs, meta, err
+}
+
+type endpointsHealth struct{ *Endpoints }
+
+func (e endpointsHealth) Service(service, tag string, passingOnly bool, qo *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	idx, client := e.current()
+	entries, meta, err := client.Health().Service(service, tag, passingOnly, qo)
+	e.check(idx, err)
+	return entries, meta, err
+}
+
+type endpointsNamespaces struct{ *Endpoints }
+
+func (e endpointsNamespaces) List(qo *api.QueryOptions) ([]*api.Namespace, *api.QueryMeta, error) {
+	idx, client := e.current()
+	namespaces, meta, err := client.Namespaces().List(qo)
+	e.check(idx, err)
+	return namespaces, meta, err
+}
+
+var _ Client = endpointsCatalog{}
+var _ KVClient = endpointsKV{}
+var _ HealthClient = endpointsHealth{}
+var _ NamespaceClient = endpointsNamespaces{}
@@ -0,0 +1,118 @@
+// Copyright © 2022 Roberto Hidalgo <coredns-consul@un.rob.mx>
+// SPDX-License-Identifier: Apache-2.0
+package catalog
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEndpointsFailback(t *testing.T) {
+	interval := endpointFailbackInterval
+	endpointFailbackInterval = 0
+	defer func() { endpointFailbackInterval = interval }()
+
+	var preferredUp atomic.Bool
+	newAgent := func(up *atomic.Bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if up != nil && !up.Load() {
+				http.Error(w, "no leader", http.StatusInternalServerError)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/v1/status/leader":
+				_, _ = w.Write([]byte(`"10.0.0.1:8300"`))
+			case "/v1/catalog/services":
+				w.Header().Set("X-Consul-Index", "3")
+				_, _ = w.Write([]byte(`{"git": ["coredns.enabled"]}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+
+	preferred := newAgent(&preferredUp)
+	defer preferred.Close()
+	fallback := newAgent(nil)
+	defer fallback.Close()
+
+	addresses := []string{preferred.Listener.Addr().String(), fallback.Listener.Addr().String()}
+	catalog, _, _, _, err := CreateClient("http", addresses, "", api.TLSConfig{})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	endpoints := catalog.(endpointsCatalog).Endpoints
+	endpoints.setLabels("dns://:53", "example.com.")
+
+	if _, _, err := catalog.Services(nil); err == nil {
+		t.Fatalf("Expected the preferred endpoint to fail")
+	}
+
+	if active := endpoints.Active(); active != addresses[1] {
+		t.Fatalf("Expected %s to be active, got %s", addresses[1], active)
+	}
+
+	preferredUp.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for endpoints.Active() != addresses[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected queries to go back to %s", addresses[0])
+		}
+		if _, _, err := catalog.Services(nil); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if active := testutil.ToFloat64(EndpointActive.WithLabelValues("dns://:53", "example.com.", addresses[0])); active != 1 {
+		t.Fatalf("Expected %s to be reported as active, got %v", addresses[0], active)
+	}
+
+	if series := testutil.ToFloat64(EndpointActive.WithLabelValues("", "", addresses[0])); series != 0 {
+		t.Fatalf("Expected unlabeled endpoints to be removed, got %v", series)
+	}
+}
+
+func TestEndpointsRotateOnce(t *testing.T) {
+	var probes atomic.Int32
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(`"10.0.0.1:8300"`))
+	}))
+	defer fallback.Close()
+
+	addresses := []string{"127.0.0.1:1", fallback.Listener.Addr().String()}
+	catalog, _, _, _, err := CreateClient("http", addresses, "", api.TLSConfig{})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	endpoints := catalog.(endpointsCatalog).Endpoints
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			endpoints.check(0, errors.New("connection refused"))
+		}()
+	}
+	wg.Wait()
+
+	if active := endpoints.Active(); active != addresses[1] {
+		t.Fatalf("Expected %s to be active, got %s", addresses[1], active)
+	}
+
+	if count := probes.Load(); count != 1 {
+		t.Fatalf("Expected a single probe of the next endpoint, got %d", count)
+	}
+}
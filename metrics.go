@@ -3,7 +3,11 @@
 package catalog
 
 import (
+	"context"
+	"strings"
+
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -38,4 +42,194 @@ var (
 		Name:      "dropped_requests_total",
 		Help:      "Counter of DNS requests being dropped.",
 	}, []string{"server", "view"})
+	// RequestServiceCount is the number of DNS requests answered for a service, when
+	// enabled with name_metrics.
+	RequestServiceCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "service_requests_total",
+		Help:      "Counter of DNS requests answered for a service.",
+	}, []string{"server", "view", "service"})
+	// RequestDuration is how long the plugin takes to answer DNS requests.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "request_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time taken to answer DNS requests, including upstream lookups.",
+	}, []string{"server", "view"})
+	// WatchLastContact is how long ago the server answering a watch's last query heard
+	// from the leader.
+	WatchLastContact = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_last_contact_seconds",
+		Help:      "Seconds since the server answering a watch's last query was in contact with the leader.",
+	}, []string{"source"})
+	// WatchKnownLeader is whether the server answering a watch's last query knew of a leader.
+	WatchKnownLeader = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_known_leader",
+		Help:      "Whether the server answering a watch's last query knew of a leader.",
+	}, []string{"source"})
+	// WatchLastIndex is the consul index of the last result a watch processed.
+	WatchLastIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_last_index",
+		Help:      "Consul index of the last result a watch processed.",
+	}, []string{"source"})
+	// WatchLastRefresh is when a watch last got a successful answer from consul.
+	WatchLastRefresh = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_last_refresh_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful answer from consul to a watch.",
+	}, []string{"source"})
+	// WatchResolveCount is the number of times a watch queried consul, by result.
+	WatchResolveCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_resolves_total",
+		Help:      "Counter of consul queries made by a watch, by result.",
+	}, []string{"source", "result"})
+	// WatchRecords is the number of services and aliases served from a watch.
+	WatchRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_records",
+		Help:      "Number of services and aliases served from a watch.",
+	}, []string{"source", "kind"})
+	// WatchProcessDuration is how long a watch takes to process a result.
+	WatchProcessDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "watch_process_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time taken by a watch to process a result.",
+	}, []string{"source"})
+	// EndpointActive is whether queries are being sent to a consul endpoint.
+	EndpointActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "endpoint_active",
+		Help:      "Whether queries are being sent to a consul endpoint.",
+	}, []string{"server", "zone", "endpoint"})
 )
+
+// metricsSource returns the source label of a watch's metrics, and whether other watches
+// share it. The watches of every service in a catalog share one, so metrics don't grow
+// with the number of services.
+func (w *Watch) metricsSource() (string, bool) {
+	switch src := w.watcher.(type) {
+	case *WatchKVPath:
+		return "kv:" + src.Key, false
+	case *WatcKVPrefix:
+		return "kv_prefix:" + src.Prefix, false
+	case *WatchACLZones:
+		return "acl_zones:" + src.Key, false
+	case *WatchConsulNamespaces:
+		return "namespaces", false
+	case *WatchConsulCatalog:
+		return scopedSource("catalog", src.Namespace, src.Datacenter), false
+	case *WatchConsulService:
+		return scopedSource("services", src.Namespace, src.Datacenter), true
+	}
+	return w.Name(), false
+}
+
+// scopedSource returns the source label of a watch in a namespace or datacenter other
+// than the agent's, i.e. `catalog:team-a.ns`.
+func scopedSource(source, namespace, datacenter string) string {
+	if scope := strings.TrimPrefix(inDatacenter(inNamespace("", namespace), datacenter), "."); scope != "" {
+		return source + ":" + scope
+	}
+	return source
+}
+
+// recordMetrics reports a processed result of the watch. Watches sharing their source
+// add their records to it instead of replacing them, and leave the index out. It must be
+// called while holding the watch's lock.
+func (w *Watch) recordMetrics(index uint64, services, aliases int) {
+	source, shared := w.metricsSource()
+	if !shared {
+		WatchLastIndex.WithLabelValues(source).Set(float64(index))
+		WatchRecords.WithLabelValues(source, "service").Set(float64(services))
+		WatchRecords.WithLabelValues(source, "alias").Set(float64(aliases))
+		return
+	}
+
+	if w.records == nil {
+		w.records = map[string]int{}
+	}
+	for kind, count := range map[string]int{"service": services, "alias": aliases} {
+		WatchRecords.WithLabelValues(source, kind).Add(float64(count - w.records[kind]))
+		w.records[kind] = count
+	}
+}
+
+// forgetWatchMetrics removes the metrics of a watch that is no longer running, or its
+// records from those of its source if shared with other watches.
+func forgetWatchMetrics(w *Watch) {
+	source, shared := w.metricsSource()
+	if shared {
+		w.Lock()
+		defer w.Unlock()
+		for kind, count := range w.records {
+			WatchRecords.WithLabelValues(source, kind).Sub(float64(count))
+		}
+		w.records = nil
+		return
+	}
+
+	WatchLastContact.DeleteLabelValues(source)
+	WatchKnownLeader.DeleteLabelValues(source)
+	WatchLastIndex.DeleteLabelValues(source)
+	WatchLastRefresh.DeleteLabelValues(source)
+	WatchResolveCount.DeletePartialMatch(prometheus.Labels{"source": source})
+	WatchRecords.DeletePartialMatch(prometheus.Labels{"source": source})
+	WatchProcessDuration.DeleteLabelValues(source)
+}
+
+// forgetRequestNames releases the NameMetricsLimit slots of services no longer served,
+// and removes their request counts.
+func (c *Catalog) forgetRequestNames(services ServiceMap) {
+	c.metricNamesLock.Lock()
+	defer c.metricNamesLock.Unlock()
+	for name := range c.metricNames {
+		if _, ok := services[name]; !ok {
+			delete(c.metricNames, name)
+			RequestServiceCount.DeletePartialMatch(prometheus.Labels{"service": name})
+		}
+	}
+}
+
+// otherServices is the service label of requests for services past NameMetricsLimit.
+const otherServices = "other"
+
+// countRequest counts a request answered for svc by the name of the service it aliases,
+// if any. Services beyond the first NameMetricsLimit seen among those being served are
+// counted as otherServices.
+func (c *Catalog) countRequest(ctx context.Context, svc *Service) {
+	if c.NameMetricsLimit <= 0 {
+		return
+	}
+
+	name := svc.Name
+	if svc.AliasOf != "" {
+		name = svc.AliasOf
+	}
+
+	c.metricNamesLock.Lock()
+	if !c.metricNames[name] {
+		if len(c.metricNames) < c.NameMetricsLimit {
+			c.metricNames[name] = true
+		} else {
+			name = otherServices
+		}
+	}
+	c.metricNamesLock.Unlock()
+
+	RequestServiceCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx), name).Inc()
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/file"
@@ -16,6 +17,23 @@ import (
 	"github.com/miekg/dns"
 )
 
+// addressRecord returns an A or AAAA record for addr, matching the type in header, or
+// nil if addr does not belong to the requested address family.
+func addressRecord(header dns.RR_Header, addr net.IP) dns.RR {
+	if header.Rrtype == dns.TypeAAAA {
+		if addr.To4() != nil || addr.To16() == nil {
+			return nil
+		}
+		return &dns.AAAA{Hdr: header, AAAA: addr.To16()}
+	}
+
+	v4 := addr.To4()
+	if v4 == nil {
+		return nil
+	}
+	return &dns.A{Hdr: header, A: v4}
+}
+
 func ProxiedAddressesByProximity(source net.IP, svc *Service, target *Service, header dns.RR_Header) []dns.RR {
 	addressWeights := map[string]int{}
 
@@ -32,9 +50,9 @@ func ProxiedAddressesByProximity(source net.IP, svc *Service, target *Service, h
 	middle := []dns.RR{}
 	tail := []dns.RR{}
 	for _, addr := range target.Addresses {
-		record := &dns.A{
-			Hdr: header,
-			A:   addr,
+		record := addressRecord(header, addr)
+		if record == nil {
+			continue
 		}
 		weight, ok := addressWeights[addr.String()]
 		if !ok {
@@ -56,17 +74,133 @@ func ProxiedAddressesByProximity(source net.IP, svc *Service, target *Service, h
 	return res
 }
 
-// ServeDNS implements plugin.Handler.
-func (c *Catalog) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	state := request.Request{W: w, Req: r, Zone: c.Zone}
+// srvServiceName returns the service name for an RFC 2782 style query, i.e. `_name._tcp`.
+func srvServiceName(name string) string {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) < 2 || !strings.HasPrefix(labels[0], "_") {
+		return name
+	}
+
+	if labels[1] != "_tcp" && labels[1] != "_udp" {
+		return name
+	}
+
+	service := strings.TrimPrefix(labels[0], "_")
+	if len(labels) == 3 {
+		service += "." + labels[2]
+	}
+	return service
+}
+
+// instanceHost returns the name SRV records point to for a service instance.
+func instanceHost(instance *ServiceInstance, service, zone string) string {
+	return dns.Fqdn(fmt.Sprintf("%s.%s.%s", instance.Node, service, zone))
+}
 
-	name := state.QName()
+// queryName returns the service name a request is for, and the zone it was made in.
+func (c *Catalog) queryName(state request.Request) (name string, zone string) {
+	name = state.QName()
 	for _, fqdn := range c.FQDN {
-		name = strings.Replace(name, "."+fqdn, "", 1)
+		if stripped := strings.Replace(name, "."+fqdn, "", 1); stripped != name {
+			name = stripped
+			zone = fqdn
+		}
 	}
 
-	svc := c.ServiceFor(name)
+	if state.QType() == dns.TypeSRV {
+		name = srvServiceName(name)
+	}
+	return
+}
+
+// lookup returns the service answering for name, and the instance of it name refers to,
+// if any.
+func (c *Catalog) lookup(name string) (*Service, *ServiceInstance) {
+	if svc := c.ServiceFor(name); svc != nil {
+		return svc, nil
+	}
+
+	if svc, instance := c.InstanceFor(name); svc != nil {
+		return svc, instance
+	}
+
+	return c.FailoverFor(name), nil
+}
 
+// clientSubnet returns the network a request's ACL is evaluated against: the EDNS0 client
+// subnet of requests from trusted forwarders, or the address the request came from. The
+// client subnet option is returned when used.
+func (c *Catalog) clientSubnet(state request.Request) (*net.IPNet, *dns.EDNS0_SUBNET) {
+	ip := net.ParseIP(state.IP())
+	client := hostNetwork(ip)
+
+	trusted := false
+	for _, network := range c.ClientSubnetTrusted {
+		if network.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+
+	opt := state.Req.IsEdns0()
+	if !trusted || opt == nil {
+		return client, nil
+	}
+
+	for _, option := range opt.Option {
+		ecs, ok := option.(*dns.EDNS0_SUBNET)
+		// a source prefix of 0 asks for the client's address not to be used
+		if !ok || ecs.SourceNetmask == 0 {
+			continue
+		}
+
+		bits := 32
+		if ecs.Family == 2 {
+			bits = 128
+		}
+		mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+		if mask == nil {
+			Log.Warningf("Ignoring client subnet %s/%d from %s: invalid prefix length", ecs.Address, ecs.SourceNetmask, ip)
+			continue
+		}
+
+		subnet := &net.IPNet{IP: ecs.Address.Mask(mask), Mask: mask}
+		if subnet.IP == nil {
+			Log.Warningf("Ignoring client subnet %s/%d from %s: address does not match family", ecs.Address, ecs.SourceNetmask, ip)
+			continue
+		}
+
+		Log.Debugf("Using client subnet %s from %s", subnet, ip)
+		return subnet, ecs
+	}
+
+	return client, nil
+}
+
+// setClientSubnetScope adds the client subnet option used to answer a request to its
+// reply, scoped to the subnet, so forwarders don't cache it for clients in other networks.
+func setClientSubnetScope(m *dns.Msg, r *dns.Msg, ecs *dns.EDNS0_SUBNET) {
+	if ecs == nil {
+		return
+	}
+
+	opt := r.IsEdns0()
+	m.SetEdns0(opt.UDPSize(), opt.Do())
+	scoped := *ecs
+	scoped.SourceScope = ecs.SourceNetmask
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &scoped)
+}
+
+// ServeDNS implements plugin.Handler.
+func (c *Catalog) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	start := time.Now()
+	defer func() {
+		RequestDuration.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Observe(time.Since(start).Seconds())
+	}()
+	state := request.Request{W: w, Req: r, Zone: c.Zone}
+
+	name, zone := c.queryName(state)
+	svc, instance := c.lookup(name)
 	if svc == nil {
 		Log.Debugf("Zone not found: %s", name)
 		return plugin.NextOrFailure("consul_catalog", c.Next, ctx, w, r)
@@ -74,17 +208,36 @@ func (c *Catalog) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 
 	log.Debugf("Found target service: %+v", svc)
 
-	ip := net.ParseIP(state.IP())
-	if len(c.Networks) > 0 {
-		if !svc.RespondsTo(ip) {
-			Log.Warningf("Blocked resolution for service %s from ip %s", name, ip)
-			RequestACLDeniedCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Inc()
-			return plugin.NextOrFailure("consul_catalog", c.Next, ctx, w, r)
-		}
+	client, ecs := c.clientSubnet(state)
+	if allowed, _, _ := c.allows(svc, client, state.QType()); !allowed {
+		Log.Warningf("Blocked resolution for service %s from %s", name, client)
+		RequestACLDeniedCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Inc()
+		return c.deny(ctx, w, r, ecs)
+	}
+
+	c.countRequest(ctx, svc)
+
+	m, source, err := c.answer(ctx, state, svc, instance, client, zone)
+	if err != nil {
+		return 0, err
+	}
+
+	setClientSubnetScope(m, r, ecs)
+	if source == "" {
+		return c.writeNoData(ctx, w, m, name, state.Type())
 	}
 
+	RequestServedCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx), source).Inc()
+	err = w.WriteMsg(m)
+	return dns.RcodeSuccess, err
+}
+
+// answer returns the reply to a request for svc, or instance of it, from a client network,
+// and where its records were found. The source is empty if there are no records for the
+// requested type.
+func (c *Catalog) answer(ctx context.Context, state request.Request, svc *Service, instance *ServiceInstance, client *net.IPNet, zone string) (*dns.Msg, string, error) {
 	m := new(dns.Msg)
-	m.SetReply(r)
+	m.SetReply(state.Req)
 	m.Authoritative = true
 	m.Rcode = dns.RcodeSuccess
 	m.Compress = true
@@ -97,79 +250,258 @@ func (c *Catalog) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 		Ttl:    c.TTL,
 	}
 
+	m.Ns = c.authority()
+
+	switch state.QType() {
+	case dns.TypeA, dns.TypeAAAA:
+		if instance != nil {
+			Log.Debugf("Found instance %s of %s", instance.Node, svc.Name)
+			instance = instance.In(c.horizon(svc, client))
+			if instance.Host != "" {
+				m.Answer = append(m.Answer, c.cnameFor(ctx, state, instance.Host, header)...)
+				return m, "api", nil
+			}
+
+			if record := addressRecord(header, instance.Address); record != nil {
+				m.Answer = append(m.Answer, record)
+			}
+			return m, "api", nil
+		}
+
+		answers, source, err := c.addressesFor(ctx, state, svc, client, header)
+		if err != nil {
+			return nil, "", err
+		}
+		m.Answer = append(m.Answer, answers...)
+		return m, source, nil
+	case dns.TypeSRV:
+		m.Answer, m.Extra = c.srvRecordsFor(svc, client, header, zone)
+		if len(m.Answer) == 0 {
+			return m, "", nil
+		}
+		return m, "api", nil
+	default:
+		return m, "", nil
+	}
+}
+
+// authority returns the SOA of the zone from the file plugin, if available and next in
+// the chain, so negative answers can be cached.
+func (c *Catalog) authority() []dns.RR {
 	if fp, ok := c.Next.(file.File); ok && len(fp.Zones.Z) > 0 {
-		// grab the SOA from the file plugin, if available and next in the chain
 		if zone, ok := fp.Zones.Z[c.FQDN[0]]; ok {
 			Log.Debugf("Adding SOA %s", zone.SOA.String())
-			m.Ns = []dns.RR{zone.SOA}
+			return []dns.RR{zone.SOA}
 		}
 	}
+	return nil
+}
 
-	if state.QType() != dns.TypeA {
-		// return NODATA
-		Log.Debugf("Record for %s does not contain answers for type %s", name, state.Type())
-		RequestDropCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Inc()
-		err := w.WriteMsg(m)
-		return dns.RcodeSuccess, err
+// deny answers a request denied by a service's ACL according to ACLDenyResponse.
+func (c *Catalog) deny(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, ecs *dns.EDNS0_SUBNET) (int, error) {
+	m := new(dns.Msg)
+	switch c.ACLDenyResponse {
+	case DenyRefused:
+		m.SetRcode(r, dns.RcodeRefused)
+	case DenyNXDomain:
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Authoritative = true
+		m.Ns = c.authority()
+	case DenyNoData:
+		m.SetRcode(r, dns.RcodeSuccess)
+		m.Authoritative = true
+		m.Ns = c.authority()
+	default:
+		return plugin.NextOrFailure("consul_catalog", c.Next, ctx, w, r)
 	}
 
-	lookupName := svc.Target
+	setClientSubnetScope(m, r, ecs)
+	RequestBlockCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Inc()
+	err := w.WriteMsg(m)
+	return dns.RcodeSuccess, err
+}
+
+func (c *Catalog) writeNoData(ctx context.Context, w dns.ResponseWriter, m *dns.Msg, name, qtype string) (int, error) {
+	Log.Debugf("Record for %s does not contain answers for type %s", name, qtype)
+	RequestDropCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Inc()
+	err := w.WriteMsg(m)
+	return dns.RcodeSuccess, err
+}
 
+// lookupNameFor returns the name of the service whose addresses svc answers with.
+func (c *Catalog) lookupNameFor(svc *Service) string {
 	if svc.Target == ServiceProxyTag {
-		lookupName = c.ProxyService
+		return c.ProxyService
 	}
+	return svc.Target
+}
+
+// addressesFor returns A or AAAA records for svc as seen by a client network, and where
+// they were found.
+func (c *Catalog) addressesFor(ctx context.Context, state request.Request, svc *Service, client *net.IPNet, header dns.RR_Header) ([]dns.RR, string, error) {
+	answers := []dns.RR{}
+	lookupName := c.lookupNameFor(svc)
+	svc = svc.In(c.horizon(svc, client))
 
 	Log.Debugf("looking up target: %s", lookupName)
 
-	source := ""
-	if target := c.ServiceFor(lookupName); target != nil && len(target.Addresses) > 0 {
+	target := c.targetFor(lookupName)
+	if target != nil {
+		target = target.In(c.horizon(target, client))
+	}
+
+	if target != nil && len(target.Addresses) > 0 {
 		Log.Debugf("Found addresses in catalog for %s: %v", lookupName, target.Addresses)
-		source = "api"
 
 		if svc.Target == ServiceProxyTag {
-			m.Answer = append(m.Answer, ProxiedAddressesByProximity(ip, svc, target, header)...)
-		} else {
-			for _, addr := range target.Addresses {
-				m.Answer = append(m.Answer, &dns.A{
-					Hdr: header,
-					A:   addr,
-				})
+			return ProxiedAddressesByProximity(client.IP, svc, target, header), "api", nil
+		}
+
+		for _, addr := range target.Addresses {
+			if record := addressRecord(header, addr); record != nil {
+				answers = append(answers, record)
 			}
 		}
-	} else if len(svc.Addresses) > 0 {
+		return answers, "api", nil
+	}
+
+	if target != nil && len(target.Hosts) > 0 {
+		Log.Debugf("Found hosts in catalog for %s: %v", lookupName, target.Hosts)
+		// a name has a single CNAME, so hosts take turns answering
+		return c.cnameFor(ctx, state, c.nextHost(ctx, target.Hosts), header), "api", nil
+	}
+
+	if len(svc.Addresses) > 0 {
 		Log.Debugf("Found addresses in static entry for %s: %v", svc.Name, svc.Addresses)
-		source = "kv"
 		for _, addr := range svc.Addresses {
-			m.Answer = append(m.Answer, &dns.A{
-				Hdr: header,
-				A:   addr,
-			})
+			if record := addressRecord(header, addr); record != nil {
+				answers = append(answers, record)
+			}
 		}
-	} else {
-		Log.Debugf("Looking up address for %s upstream", lookupName)
-		reply, err := DefaultLookup(ctx, state, fmt.Sprintf("%s.service.consul", lookupName))
+		return answers, "kv", nil
+	}
 
-		if err != nil {
-			return 0, plugin.Error("Failed to lookup target upstream", err)
+	if svc.Target == "" {
+		// only has addresses for acl zones other than the client's
+		return answers, "", nil
+	}
+
+	upstreamName := svc.Upstream
+	if upstreamName == "" {
+		upstreamName = fmt.Sprintf("%s.service.consul", lookupName)
+	}
+	Log.Debugf("Looking up address for %s upstream at %s", lookupName, upstreamName)
+	reply, err := c.lookupUpstream(ctx, state, upstreamName, state.QType())
+
+	if err != nil {
+		return nil, "", plugin.Error("Failed to lookup target upstream", err)
+	}
+	Log.Debugf("Found record for %s upstream", svc.Name)
+
+	for _, a := range reply.Answer {
+		var addr net.IP
+		switch record := a.(type) {
+		case *dns.A:
+			addr = record.A
+		case *dns.AAAA:
+			addr = record.AAAA
+		default:
+			Log.Warningf("Found non-address record upstream: %s", a.String())
+			continue
 		}
-		Log.Debugf("Found record for %s upstream", name)
 
-		source = "dns"
-		for _, a := range reply.Answer {
-			record, ok := a.(*dns.A)
-			if !ok {
-				Log.Warningf("Found non-A record upstream: %s", a.String())
-				continue
-			}
+		if record := addressRecord(header, addr); record != nil {
+			answers = append(answers, record)
+		}
+	}
+
+	return answers, "dns", nil
+}
 
-			m.Answer = append(m.Answer, &dns.A{
-				Hdr: header,
-				A:   record.A,
-			})
+// cnameFor returns a CNAME record pointing to host, followed by the records of the
+// requested type for host found upstream, if any.
+func (c *Catalog) cnameFor(ctx context.Context, state request.Request, host string, header dns.RR_Header) []dns.RR {
+	host = dns.Fqdn(host)
+	cnameHeader := header
+	cnameHeader.Rrtype = dns.TypeCNAME
+	answers := []dns.RR{&dns.CNAME{Hdr: cnameHeader, Target: host}}
+
+	reply, err := c.lookupUpstream(ctx, state, host, state.QType())
+	if err != nil {
+		Log.Warningf("Could not lookup %s upstream, answering with CNAME only: %s", host, err)
+		return answers
+	}
+
+	for _, rr := range reply.Answer {
+		if rrtype := rr.Header().Rrtype; rrtype == state.QType() || rrtype == dns.TypeCNAME {
+			answers = append(answers, rr)
 		}
 	}
+	return answers
+}
 
-	RequestServedCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx), source).Inc()
-	err := w.WriteMsg(m)
-	return dns.RcodeSuccess, err
+// nextHost returns the host whose turn it is to answer. Requests simulated by Explain get
+// the host the next client would, without taking its turn.
+func (c *Catalog) nextHost(ctx context.Context, hosts []string) string {
+	turn := c.hostTurn.Load()
+	if _, explaining := ctx.Value(explainKey{}).(*explainLookups); !explaining {
+		turn = c.hostTurn.Add(1) - 1
+	}
+	return hosts[turn%uint64(len(hosts))]
+}
+
+// lookupUpstream looks target up with DefaultLookup. Requests simulated by Explain only
+// record the lookup instead.
+func (c *Catalog) lookupUpstream(ctx context.Context, state request.Request, target string, qtype uint16) (*dns.Msg, error) {
+	if lookups, explaining := ctx.Value(explainKey{}).(*explainLookups); explaining {
+		lookups.names = append(lookups.names, target)
+		return new(dns.Msg), nil
+	}
+	return DefaultLookup(ctx, state, target, qtype)
+}
+
+// srvRecordsFor returns one SRV record per catalog instance of svc's target, along with
+// the A and AAAA records for each instance's host as seen by a client network.
+func (c *Catalog) srvRecordsFor(svc *Service, client *net.IPNet, header dns.RR_Header, zone string) (answers []dns.RR, extra []dns.RR) {
+	answers = []dns.RR{}
+	extra = []dns.RR{}
+
+	target := c.targetFor(c.lookupNameFor(svc))
+	if target == nil || len(target.Instances) == 0 {
+		Log.Debugf("No catalog instances found for %s", svc.Name)
+		return
+	}
+	target = target.In(c.horizon(target, client))
+
+	glued := map[string]bool{}
+	for _, instance := range target.Instances {
+		host := instanceHost(instance, target.Name, zone)
+		if instance.Host != "" {
+			// resolved by clients, no glue needed
+			host = dns.Fqdn(instance.Host)
+		}
+		answers = append(answers, &dns.SRV{
+			Hdr:      header,
+			Priority: 1,
+			Weight:   1,
+			Port:     uint16(instance.Port), // nolint: gosec
+			Target:   host,
+		})
+
+		glueKey := host + instance.Address.String()
+		if instance.Address == nil || glued[glueKey] {
+			continue
+		}
+		glued[glueKey] = true
+
+		glueHeader := dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: header.Ttl}
+		if instance.Address.To4() == nil {
+			glueHeader.Rrtype = dns.TypeAAAA
+		}
+		if record := addressRecord(glueHeader, instance.Address); record != nil {
+			extra = append(extra, record)
+		}
+	}
+
+	return
 }
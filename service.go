@@ -3,14 +3,113 @@
 package catalog
 
 import (
+	"fmt"
 	"net"
 	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // ServiceACL holds an action and corresponding network range.
 type ServiceACL struct {
-	Action   string
+	Action string
+	// Zone is the name of the acl_zone Networks belong to.
+	Zone     string
 	Networks []*net.IPNet
+	// Types are the query types the rule applies to, or every type if empty.
+	Types []uint16
+	// Window is the time of day the rule applies at, or all day if nil.
+	Window *TimeWindow
+}
+
+// AppliesTo returns whether the rule applies to a query of type qtype made at now.
+func (acl ServiceACL) AppliesTo(qtype uint16, now time.Time) bool {
+	if acl.Window != nil && !acl.Window.Contains(now) {
+		return false
+	}
+
+	if len(acl.Types) == 0 {
+		return true
+	}
+
+	for _, t := range acl.Types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeWindow is a daily period of time, ending on the next day if End is before Start.
+type TimeWindow struct {
+	// Start is the time since midnight the window starts at.
+	Start time.Duration
+	// End is the time since midnight the window ends at, exclusive.
+	End time.Duration
+}
+
+// ParseTimeWindow parses a window like `08:00-20:00`.
+func ParseTimeWindow(window string) (*TimeWindow, error) {
+	start, end, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("could not parse time window <%s>, expected HH:MM-HH:MM", window)
+	}
+
+	tw := &TimeWindow{}
+	for _, bound := range []struct {
+		value string
+		dest  *time.Duration
+	}{{start, &tw.Start}, {end, &tw.End}} {
+		parsed, err := time.Parse("15:04", bound.value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse time window <%s>, expected HH:MM-HH:MM", window)
+		}
+		*bound.dest = time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute
+	}
+
+	if tw.Start == tw.End {
+		return nil, fmt.Errorf("time window <%s> is empty", window)
+	}
+	return tw, nil
+}
+
+// Contains returns whether t, in its own location, falls within the window.
+func (tw TimeWindow) Contains(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if tw.Start < tw.End {
+		return sinceMidnight >= tw.Start && sinceMidnight < tw.End
+	}
+	return sinceMidnight >= tw.Start || sinceMidnight < tw.End
+}
+
+func (tw TimeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(tw.Start.Hours()), int(tw.Start.Minutes())%60, int(tw.End.Hours()), int(tw.End.Minutes())%60)
+}
+
+// ServiceInstance is a single registration of a service in the Consul catalog.
+type ServiceInstance struct {
+	ID      string
+	Node    string
+	Address net.IP
+	// Host is the name the instance registered as its address instead of an IP, if any.
+	Host string
+	Port int
+	// ZoneAddresses replace Address for clients in the acl zone they're keyed by.
+	ZoneAddresses map[string]net.IP
+}
+
+// In returns the instance as seen by clients in an acl zone, with the address it has
+// for that zone, if any.
+func (i *ServiceInstance) In(zone string) *ServiceInstance {
+	addr, ok := i.ZoneAddresses[zone]
+	if !ok {
+		return i
+	}
+
+	in := *i
+	in.Address = addr
+	return &in
 }
 
 // Service has a target and ACL rules.
@@ -19,6 +118,18 @@ type Service struct {
 	Target    string
 	ACL       []*ServiceACL
 	Addresses []net.IP
+	Instances []*ServiceInstance
+	// Hosts are the names instances registered as their address instead of an IP.
+	Hosts []string
+	// AliasOf is the name of the service this is an alias of, if any.
+	AliasOf string
+	// Source is the name of the watch this service was found by.
+	Source string
+	// ZoneAddresses replace Addresses for clients in the acl zone they're keyed by.
+	ZoneAddresses map[string][]net.IP
+	// Upstream is the name Target is looked up at upstream when it has no addresses, if
+	// other than `TARGET.service.consul`.
+	Upstream string
 }
 
 func NewService(name, target string) *Service {
@@ -27,25 +138,39 @@ func NewService(name, target string) *Service {
 		Target:    target,
 		ACL:       []*ServiceACL{},
 		Addresses: []net.IP{},
+		Instances: []*ServiceInstance{},
 	}
 
 	return svc
 }
 
-// RespondsTo returns if a service is allowed to talk to an IP.
+// RespondsTo returns if a service is allowed to answer A queries from an IP right now.
 func (s Service) RespondsTo(ip net.IP) bool {
+	allowed, _, _ := s.Decide(hostNetwork(ip), dns.TypeA, time.Now())
+	return allowed
+}
+
+// Decide returns if a service is allowed to answer a query of type qtype made at now by a
+// client network, along with the rule and network that decided it, or nil if no rule
+// matched. A rule only matches clients entirely within one of its networks, and is
+// skipped for query types and times it does not apply to.
+func (s Service) Decide(client *net.IPNet, qtype uint16, now time.Time) (bool, *ServiceACL, *net.IPNet) {
 	Log.Debugf("Evaluating %d rules", len(s.ACL))
 	for _, acl := range s.ACL {
+		if !acl.AppliesTo(qtype, now) {
+			continue
+		}
+
 		Log.Debugf("Evaluating %s", acl.Networks)
-		for _, net := range acl.Networks {
-			if net.Contains(ip) {
+		for _, network := range acl.Networks {
+			if containsNetwork(network, client) {
 				switch acl.Action {
 				case "allow":
-					Log.Debugf("Allowed %s from %s", ip, acl.Networks)
-					return true
+					Log.Debugf("Allowed %s from %s", client, acl.Networks)
+					return true, acl, network
 				case "deny":
-					Log.Debugf("Denied %s from %s", ip, acl.Networks)
-					return false
+					Log.Debugf("Denied %s from %s", client, acl.Networks)
+					return false, acl, network
 				default:
 					Log.Errorf("unknown acl action: %s", acl.Action)
 				}
@@ -53,7 +178,55 @@ func (s Service) RespondsTo(ip net.IP) bool {
 		}
 	}
 
-	return false
+	return false, nil, nil
+}
+
+// hostNetwork returns the network made up of just ip.
+func hostNetwork(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// containsNetwork returns whether inner is entirely within outer.
+func containsNetwork(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// In returns the service as seen by clients in an acl zone, with the addresses it and
+// its instances have for that zone, if any.
+func (s *Service) In(zone string) *Service {
+	addrs, ok := s.ZoneAddresses[zone]
+	if !ok {
+		return s
+	}
+
+	in := *s
+	in.Addresses = addrs
+	in.Instances = make([]*ServiceInstance, 0, len(s.Instances))
+	for _, instance := range s.Instances {
+		in.Instances = append(in.Instances, instance.In(zone))
+	}
+	return &in
+}
+
+// reachable returns whether the service has any addresses or hosts to answer with.
+func (s *Service) reachable() bool {
+	return len(s.Addresses) > 0 || len(s.Hosts) > 0
+}
+
+// InstanceOn returns the instance of this service registered on node, if any.
+func (s Service) InstanceOn(node string) *ServiceInstance {
+	for _, instance := range s.Instances {
+		if instance.Node == node {
+			return instance
+		}
+	}
+
+	return nil
 }
 
 type ServiceMap map[string]*Service
@@ -4,16 +4,20 @@
 package catalog
 
 import (
+	"context"
 	"net"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/cenkalti/backoff/v4"
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/hashicorp/consul/api"
 )
 
 var pluginName = "consul_catalog"
@@ -29,6 +33,7 @@ func setup(c *caddy.Controller) error {
 	}
 
 	config := dnsserver.GetConfig(c)
+	catalog.labelEndpoints(config.Transport+"://"+net.JoinHostPort(config.ListenHosts[0], config.Port), config.Zone)
 	config.AddPlugin(func(next plugin.Handler) plugin.Handler {
 		catalog.Next = next
 		catalog.Zone = config.Zone
@@ -36,40 +41,42 @@ func setup(c *caddy.Controller) error {
 	})
 
 	c.OnStartup(func() error {
-		Log.Infof("Starting %d consul catalog watches for %s", len(catalog.Sources), catalog.Endpoint)
+		Log.Infof("Starting %d consul catalog watches for %s", len(catalog.Sources), strings.Join(catalog.endpoints(), ", "))
 
 		m := dnsserver.GetConfig(c).Handler("prometheus")
 		if m != nil {
 			catalog.metrics = m.(*metrics.Metrics)
 		}
 
-		for _, watch := range catalog.Sources {
-			go func(w *Watch) {
-				Log.Infof("Starting lookup for %s", w.Name())
-				for {
-					Log.Debugf("Looking up %s", w.Name())
-
-					onUpdateError := func(err error, cooldown time.Duration) {
-						Log.Errorf("Could not lookup %s, retrying in %vs: %v", w.Name(), cooldown.Truncate(time.Second), err)
-					}
-					err := backoff.RetryNotify(func() error {
-						_, err := w.Resolve(catalog)
-						return err
-					}, backoff.NewExponentialBackOff(), onUpdateError)
+		if err := catalog.LoadSnapshot(); err != nil {
+			Log.Warningf("Could not load snapshot from %s: %s", catalog.Snapshot.Path, err)
+		}
 
-					if err != nil {
-						continue
-					}
+		catalog.Start(context.Background())
+		return nil
+	})
 
-					catalog.Lock()
-					catalog.lastUpdate = time.Now()
-					catalog.Unlock()
-				}
-			}(watch)
-		}
+	stop := func() error {
+		Log.Infof("Stopping consul catalog watches for %s", strings.Join(catalog.endpoints(), ", "))
+		catalog.Stop()
+		return nil
+	}
+	c.OnRestart(stop)
+	c.OnShutdown(stop)
+	c.OnRestartFailed(func() error {
+		Log.Infof("Restarting consul catalog watches for %s", strings.Join(catalog.endpoints(), ", "))
+		catalog.Start(context.Background())
 		return nil
 	})
 
+	if catalog.DebugAddr != "" {
+		debug := &debugServer{addr: catalog.DebugAddr, catalog: catalog}
+		c.OnStartup(debug.start)
+		c.OnRestart(debug.stop)
+		c.OnShutdown(debug.stop)
+		c.OnRestartFailed(debug.start)
+	}
+
 	return nil
 }
 
@@ -77,31 +84,128 @@ func parse(c *caddy.Controller) (cc *Catalog, err error) { // nolint: gocyclo
 	cc = New()
 
 	token := ""
+	tokenFile := ""
 	networks := map[string][]*net.IPNet{}
-	tag := defaultTag
+	tags := []string{defaultTag}
+	tagMatch := TagMatchAny
+	datacenters := []string{}
+	schemeSet := false
 	for c.Next() {
-		tags := c.RemainingArgs()
-		if len(tags) > 0 {
-			tag = tags[0]
+		if args := c.RemainingArgs(); len(args) > 0 {
+			tags = args
 		}
 
 		for c.NextBlock() {
 			switch c.Val() {
 			case "endpoint":
-				if !c.NextArg() {
+				cc.Endpoints = c.RemainingArgs()
+				if len(cc.Endpoints) == 0 {
 					return nil, c.ArgErr()
 				}
-				cc.Endpoint = c.Val()
+				cc.Endpoint = cc.Endpoints[0]
 			case "scheme":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
 				cc.Scheme = c.Val()
+				schemeSet = true
+			case "tls_ca":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				info, err := os.Stat(c.Val())
+				if err != nil {
+					return nil, c.Errf("unable to read tls_ca: %v", err)
+				}
+				if info.IsDir() {
+					cc.TLS.CAPath = c.Val()
+				} else {
+					cc.TLS.CAFile = c.Val()
+				}
+			case "tls_cert":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.TLS.CertFile = c.Val()
+			case "tls_key":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.TLS.KeyFile = c.Val()
+			case "tls_server_name":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.TLS.Address = c.Val()
+			case "tls_skip_verify":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.TLS.InsecureSkipVerify = true
 			case "token":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
 				token = c.Val()
+			case "tag_match":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case TagMatchAny, TagMatchAll:
+					tagMatch = c.Val()
+				default:
+					return nil, c.Errf("tag_match must be one of any or all, got %q", c.Val())
+				}
+			case "token_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				tokenFile = c.Val()
+			case "namespace":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.Namespace = c.Val()
+			case "partition":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.Partition = c.Val()
+			case "consistency":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case ConsistencyDefault, ConsistencyStale, ConsistencyConsistent:
+					cc.Consistency = c.Val()
+				default:
+					return nil, c.Errf("consistency must be one of default, stale or consistent, got %q", c.Val())
+				}
+			case "max_stale":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				maxStale, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, c.Errf("Could not parse max_stale as golang duration: %v", err)
+				}
+				cc.MaxStale = maxStale
+			case "use_cache":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.UseCache = true
+			case "datacenters":
+				datacenters = c.RemainingArgs()
+				if len(datacenters) == 0 {
+					return nil, c.ArgErr()
+				}
+			case "datacenter_failover":
+				cc.Failover = c.RemainingArgs()
+				if len(cc.Failover) == 0 {
+					return nil, c.ArgErr()
+				}
 			case "ttl":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -135,6 +239,44 @@ func parse(c *caddy.Controller) (cc *Catalog, err error) { // nolint: gocyclo
 					}
 					networks[zoneName] = append(networks[zoneName], network)
 				}
+			case "acl_zones_path":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.ZonesPath = c.Val()
+			case "acl_client_subnet":
+				remaining := c.RemainingArgs()
+				if len(remaining) == 0 {
+					return nil, c.Errf("must supply the cidr ranges of trusted forwarders for acl_client_subnet")
+				}
+
+				for _, netRange := range remaining {
+					_, network, err := net.ParseCIDR(netRange)
+					if err != nil {
+						return nil, c.Errf("unable to parse network range <%s> of acl_client_subnet", netRange)
+					}
+					cc.ClientSubnetTrusted = append(cc.ClientSubnetTrusted, network)
+				}
+			case "acl_default":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case ACLAllow, ACLDeny:
+					cc.ACLDefault = c.Val()
+				default:
+					return nil, c.Errf("acl_default must be one of allow or deny, got %q", c.Val())
+				}
+			case "acl_deny_response":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case DenyNext, DenyRefused, DenyNXDomain, DenyNoData:
+					cc.ACLDenyResponse = c.Val()
+				default:
+					return nil, c.Errf("acl_deny_response must be one of next, refused, nxdomain or nodata, got %q", c.Val())
+				}
 			case "service_proxy":
 				remaining := c.RemainingArgs()
 				if len(remaining) < 1 {
@@ -144,11 +286,69 @@ func parse(c *caddy.Controller) (cc *Catalog, err error) { // nolint: gocyclo
 				cc.ProxyTag = remaining[0]
 				cc.ProxyService = remaining[1]
 				Log.Debugf("Found proxy config for tag %s and service %s", cc.ProxyTag, cc.ProxyService)
+			case "tagged_address":
+				cc.AddressTags = c.RemainingArgs()
+				if len(cc.AddressTags) == 0 {
+					return nil, c.ArgErr()
+				}
+			case "health_status":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case api.HealthPassing, api.HealthWarning:
+					cc.HealthStatus = c.Val()
+				default:
+					return nil, c.Errf("health_status must be one of passing or warning, got %q", c.Val())
+				}
+			case "health_fallback":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "all":
+					cc.HealthFallback = true
+				case "none":
+					cc.HealthFallback = false
+				default:
+					return nil, c.Errf("health_fallback must be one of all or none, got %q", c.Val())
+				}
 			case "alias_metadata_tag":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
 				cc.AliasTag = c.Val()
+			case "name_metrics":
+				cc.NameMetricsLimit = defaultNameMetricsLimit
+				if c.NextArg() {
+					limit, err := strconv.Atoi(c.Val())
+					if err != nil || limit < 1 {
+						return nil, c.Errf("name_metrics must be a positive number of services, got %q", c.Val())
+					}
+					cc.NameMetricsLimit = limit
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "debug_listen":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.DebugAddr = c.Val()
+			case "ready_timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, c.Errf("Could not parse ready_timeout as golang duration: %v", err)
+				}
+				cc.ReadyTimeout = timeout
+			case "snapshot_path":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cc.Snapshot = NewSnapshot(c.Val())
 			case "static_entries_path":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -172,15 +372,59 @@ func parse(c *caddy.Controller) (cc *Catalog, err error) { // nolint: gocyclo
 	}
 
 	// Add catalog services watcher last
-	cc.Sources = append(cc.Sources, NewWatch(&WatchConsulCatalog{Tag: tag}))
+	cc.AddSource(NewWatch(&WatchConsulCatalog{Tags: tags, Match: tagMatch}))
+	for _, dc := range cc.Failover {
+		if !slices.Contains(datacenters, dc) {
+			datacenters = append(datacenters, dc)
+		}
+	}
+	for _, dc := range datacenters {
+		cc.AddSource(NewWatch(&WatchConsulCatalog{Tags: tags, Match: tagMatch, Datacenter: dc}))
+	}
+	if cc.Namespace == NamespaceWildcard {
+		cc.AddSource(NewWatch(&WatchConsulNamespaces{Tags: tags, Match: tagMatch}))
+	}
 
 	cc.Networks = networks
+	if cc.ZonesPath != "" {
+		// zones are resolved first, so services are evaluated against them
+		cc.Sources = append([]*Watch{NewWatch(&WatchACLZones{Key: cc.ZonesPath})}, cc.Sources...)
+	}
+
+	if token == "" && tokenFile == "" {
+		token = os.Getenv(api.HTTPTokenEnvName)
+		tokenFile = os.Getenv(api.HTTPTokenFileEnvName)
+	}
+
+	if tokenFile != "" {
+		cc.TokenFile, err = NewTokenFile(tokenFile)
+		if err != nil {
+			return nil, c.Errf("Could not read token_file: %v", err)
+		}
+		token = cc.TokenFile.Token()
+	}
+
+	if (cc.TLS.CertFile == "") != (cc.TLS.KeyFile == "") {
+		return nil, c.Errf("tls_cert and tls_key must be specified together")
+	}
+
+	tls := cc.TLS.CAFile != "" || cc.TLS.CAPath != "" || cc.TLS.CertFile != "" || cc.TLS.Address != "" || cc.TLS.InsecureSkipVerify
+	if tls && !schemeSet {
+		cc.Scheme = "https"
+	}
+	if tls && cc.Scheme != "https" {
+		return nil, c.Errf("tls options require scheme https, got %s", cc.Scheme)
+	}
+
+	if cc.UseCache && cc.Consistency == ConsistencyConsistent {
+		return nil, c.Errf("use_cache cannot be used with consistency consistent")
+	}
 
-	catalogClient, kvClient, err := CreateClient(cc.Scheme, cc.Endpoint, token)
+	catalogClient, kvClient, healthClient, namespaceClient, err := CreateClient(cc.Scheme, cc.endpoints(), token, cc.TLS)
 	if err != nil {
 		return nil, c.Errf("Could not create consul client: %v", err)
 	}
-	cc.SetClients(catalogClient, kvClient)
+	cc.SetClients(catalogClient, kvClient, healthClient, namespaceClient)
 
 	for _, server := range c.ServerBlockKeys {
 		cc.FQDN = append(cc.FQDN, plugin.Host(server).NormalizeExact()...)
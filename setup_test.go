@@ -19,6 +19,8 @@ func TestSetup(t *testing.T) {
 		input       string
 		shouldError bool
 		tags        []string
+		tagMatch    string
+		datacenters []string
 		endpoint    string
 		ttl         uint32
 		metaTag     string
@@ -48,6 +50,23 @@ func TestSetup(t *testing.T) {
 			ttl:         defaultTTL,
 			metaTag:     defaultACLTag,
 		},
+		{
+			input: `consul_catalog some.tag !other.tag {
+				tag_match all
+			}`,
+			shouldError: false,
+			tags:        []string{"some.tag", "!other.tag"},
+			tagMatch:    TagMatchAll,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				tag_match some
+			}`,
+			shouldError: true,
+		},
 		{
 			input: `consul_catalog {
 				endpoint consul.local:1111
@@ -58,6 +77,22 @@ func TestSetup(t *testing.T) {
 			ttl:         defaultTTL,
 			metaTag:     defaultACLTag,
 		},
+		{
+			input: `consul_catalog {
+				endpoint consul-1.local:8500 consul-2.local:8500
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    "consul-1.local:8500 consul-2.local:8500",
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				endpoint
+			}`,
+			shouldError: true,
+		},
 		{
 			input: `consul_catalog {
 				ttl 15s
@@ -84,6 +119,7 @@ func TestSetup(t *testing.T) {
 				acl_zone private 10.0.0.1/24
 				acl_zone multiple 172.16.0.0/12 192.168.0.0/16
 				acl_zone public 0.0.0.0/0
+				acl_zone private6 fd00::/8
 			}`,
 			shouldError: false,
 			tags:        defaultTags,
@@ -101,8 +137,272 @@ func TestSetup(t *testing.T) {
 				"public": {
 					{IP: net.ParseIP("0.0.0.0"), Mask: net.IPv4Mask(0, 0, 0, 0)},
 				},
+				"private6": {
+					{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(8, 128)},
+				},
 			},
 		},
+		{
+			input: `consul_catalog {
+				acl_client_subnet 10.0.0.53/32 fd00::53/128
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				tagged_address lan_ipv4 lan
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				tagged_address
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				acl_zones_path dns/zones
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				acl_zones_path
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				acl_client_subnet
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				acl_client_subnet 10.0.0.53
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				acl_default allow
+				acl_deny_response refused
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				acl_default maybe
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				acl_deny_response servfail
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				health_status warning
+				health_fallback all
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				health_status critical
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				health_fallback some
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				datacenters dc2 dc3
+				datacenter_failover dc2 dc4
+			}`,
+			shouldError: false,
+			datacenters: []string{"dc2", "dc3", "dc4"},
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				namespace *
+				partition team
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				datacenters
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				consistency stale
+				max_stale 5s
+				use_cache
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				consistency eventually
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				max_stale forever
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				consistency consistent
+				use_cache
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				token_file /does/not/exist
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				tls_ca /does/not/exist.pem
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				tls_cert /does/not/exist.pem
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				tls_server_name consul.test
+				tls_skip_verify
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				tls_skip_verify
+				scheme http
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				scheme http
+				tls_skip_verify
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				snapshot_path /var/lib/coredns/consul.json
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				snapshot_path
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				name_metrics
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				name_metrics 0
+			}`,
+			shouldError: true,
+		},
+		{
+			input: `consul_catalog {
+				debug_listen localhost:9154
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				ready_timeout 30s
+			}`,
+			shouldError: false,
+			tags:        defaultTags,
+			endpoint:    defaultEndpoint,
+			ttl:         defaultTTL,
+			metaTag:     defaultACLTag,
+		},
+		{
+			input: `consul_catalog {
+				ready_timeout soon
+			}`,
+			shouldError: true,
+		},
 		{
 			input: `consul_catalog {
 				whatever
@@ -127,14 +427,46 @@ func TestSetup(t *testing.T) {
 				t.Fatalf("Expected no errors, but got: %v", err)
 			}
 
-			lastSourceDesc := strings.Split(catalog.Sources[len(catalog.Sources)-1].Name(), " ")
-			lastSourceName := lastSourceDesc[len(lastSourceDesc)-1]
-			if lastSourceName != tst.tags[0] {
-				t.Fatalf("Tags don't match: %v != %v", lastSourceName, tst.tags[0])
+			var catalogSource *WatchConsulCatalog
+			for _, src := range catalog.Sources {
+				if candidate, ok := src.watcher.(*WatchConsulCatalog); ok && candidate.Datacenter == "" {
+					catalogSource = candidate
+				}
+			}
+			if strings.Join(catalogSource.Tags, ",") != strings.Join(tst.tags, ",") {
+				t.Fatalf("Tags don't match: %v != %v", catalogSource.Tags, tst.tags)
+			}
+
+			expectedMatch := tst.tagMatch
+			if expectedMatch == "" {
+				expectedMatch = TagMatchAny
+			}
+			if catalogSource.Match != expectedMatch {
+				t.Fatalf("Tag match doesn't match: %v != %v", catalogSource.Match, expectedMatch)
+			}
+
+			datacenters := []string{}
+			for _, src := range catalog.Sources {
+				if catalogSource, ok := src.watcher.(*WatchConsulCatalog); ok && catalogSource.Datacenter != "" {
+					datacenters = append(datacenters, catalogSource.Datacenter)
+				}
+			}
+			if strings.Join(datacenters, ",") != strings.Join(tst.datacenters, ",") {
+				t.Fatalf("Datacenters don't match: %v != %v", datacenters, tst.datacenters)
+			}
+
+			if endpoints := strings.Join(catalog.Endpoints, " "); endpoints != tst.endpoint {
+				t.Fatalf("Endpoints don't match: %v != %v", endpoints, tst.endpoint)
+			}
+
+			if catalog.Endpoint != catalog.Endpoints[0] {
+				t.Fatalf("Endpoint doesn't match the first endpoint: %v != %v", catalog.Endpoint, catalog.Endpoints[0])
 			}
 
-			if catalog.Endpoint != tst.endpoint {
-				t.Fatalf("Endpoint doesn't match: %v != %v", catalog.Endpoint, tst.endpoint)
+			if catalog.ZonesPath != "" {
+				if zones, ok := catalog.Sources[0].watcher.(*WatchACLZones); !ok || zones.Key != catalog.ZonesPath {
+					t.Fatalf("Expected acl zones to be watched first, got %s", catalog.Sources[0].Name())
+				}
 			}
 
 			if catalog.TTL != tst.ttl {
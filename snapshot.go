@@ -0,0 +1,149 @@
+// Copyright © 2022 Roberto Hidalgo <coredns-consul@un.rob.mx>
+// SPDX-License-Identifier: Apache-2.0
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotWriteDelay is how long changes are batched before being written to disk.
+var snapshotWriteDelay = 5 * time.Second
+
+// SnapshotEntry holds the services found by a watch's last successful Resolve.
+type SnapshotEntry struct {
+	Services ServiceMap `json:"services"`
+}
+
+// Snapshot persists the services found by every watch to a file, so they can be served
+// while consul is unreachable after a restart.
+type Snapshot struct {
+	sync.Mutex
+	Path    string
+	entries map[string]*SnapshotEntry
+	pending *time.Timer
+}
+
+// NewSnapshot returns a snapshot stored at path.
+func NewSnapshot(path string) *Snapshot {
+	return &Snapshot{Path: path, entries: map[string]*SnapshotEntry{}}
+}
+
+// Load reads the entries stored at the snapshot's path, keyed by watch name. A missing
+// file has no entries.
+func (s *Snapshot) Load() (map[string]*SnapshotEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return map[string]*SnapshotEntry{}, nil
+		}
+		return nil, err
+	}
+
+	entries := map[string]*SnapshotEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	for name, entry := range entries {
+		s.entries[name] = entry
+	}
+	return entries, nil
+}
+
+// Save stores the services found by the watch named name.
+func (s *Snapshot) Save(name string, services ServiceMap) {
+	s.Lock()
+	defer s.Unlock()
+	s.entries[name] = &SnapshotEntry{Services: services}
+	s.schedule()
+}
+
+// Forget removes the services of the watch named name.
+func (s *Snapshot) Forget(name string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[name]; !ok {
+		return
+	}
+	delete(s.entries, name)
+	s.schedule()
+}
+
+// Retain removes the services of every watch not named in names.
+func (s *Snapshot) Retain(names map[string]bool) {
+	s.Lock()
+	defer s.Unlock()
+	changed := false
+	for name := range s.entries {
+		if !names[name] {
+			delete(s.entries, name)
+			changed = true
+		}
+	}
+
+	if changed {
+		s.schedule()
+	}
+}
+
+// Flush writes any pending changes to disk right away.
+func (s *Snapshot) Flush() {
+	s.Lock()
+	defer s.Unlock()
+	if s.pending == nil {
+		return
+	}
+	s.pending.Stop()
+	s.pending = nil
+	s.write()
+}
+
+// schedule writes the snapshot once snapshotWriteDelay has passed, so that changes
+// from every watch resolving around the same time are written together. It must be
+// called while holding the snapshot's lock.
+func (s *Snapshot) schedule() {
+	if s.pending != nil {
+		return
+	}
+
+	s.pending = time.AfterFunc(snapshotWriteDelay, s.Flush)
+}
+
+// write must be called while holding the snapshot's lock.
+func (s *Snapshot) write() {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		Log.Warningf("Could not encode snapshot: %s", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".*")
+	if err != nil {
+		Log.Warningf("Could not write snapshot to %s: %s", s.Path, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		Log.Warningf("Could not write snapshot to %s: %s", s.Path, err)
+		return
+	}
+
+	if err := tmp.Close(); err != nil {
+		Log.Warningf("Could not write snapshot to %s: %s", s.Path, err)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		Log.Warningf("Could not write snapshot to %s: %s", s.Path, err)
+	}
+}
@@ -5,7 +5,12 @@ package catalog_test
 import (
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
+	"github.com/coredns/coredns/plugin/file"
 	"github.com/hashicorp/consul/api"
 	. "github.com/unRob/coredns-consul"
 )
@@ -24,18 +29,15 @@ func NewTestCatalog(fetch bool, extraSources ...*Watch) (*Catalog, Client, KVCli
 	c.Networks["public"] = []*net.IPNet{public}
 	client := NewTestCatalogClient()
 	kvClient := NewTestKVClient()
-	c.SetClients(client, kvClient)
+	c.SetClients(client, kvClient, &testHealthClient{catalog: client.(*testCatalogClient)}, &testNamespaceClient{catalog: client.(*testCatalogClient)})
 
-	catalogSource := &WatchConsulCatalog{Tag: "coredns.enabled"}
+	catalogSource := &WatchConsulCatalog{Tags: []string{"coredns.enabled"}, Match: TagMatchAny}
 	c.Sources = extraSources
-	c.Sources = append(c.Sources, NewWatch(catalogSource))
+	c.AddSource(NewWatch(catalogSource))
 
 	if fetch {
-		for _, src := range c.Sources {
-			_, err := src.Resolve(c)
-			if err != nil {
-				panic(err)
-			}
+		if err := c.ReloadAll(); err != nil {
+			panic(err)
 		}
 	}
 	return c, client, kvClient
@@ -45,20 +47,58 @@ type testServiceData struct {
 	Tags    []string
 	Meta    map[string]string
 	Address string
+	Port    int
+	Status  string
+	// ServiceAddress is the address the service registered with, the node's if empty.
+	ServiceAddress string
+	// TaggedAddresses are the service's tagged addresses, by tag.
+	TaggedAddresses map[string]string
+	// NodeTaggedAddresses are the node's tagged addresses, by tag.
+	NodeTaggedAddresses map[string]string
+}
+
+func (sd *testServiceData) taggedAddresses() map[string]api.ServiceAddress {
+	if sd.TaggedAddresses == nil {
+		return nil
+	}
+
+	tagged := map[string]api.ServiceAddress{}
+	for tag, addr := range sd.TaggedAddresses {
+		tagged[tag] = api.ServiceAddress{Address: addr, Port: sd.Port}
+	}
+	return tagged
 }
 
 type testCatalogClient struct {
+	sync.Mutex
+	// Blocking makes queries for an unchanged index wait until they're cancelled, like
+	// consul's blocking queries would.
+	Blocking  bool
 	services  map[string][]*testServiceData
+	indexes   map[string]uint64
 	lastIndex uint64
+	retagged  uint64
+	calls     map[string]int
+	// LastOptions are the options of the last query made.
+	LastOptions api.QueryOptions
+	// Datacenters holds the services of datacenters other than the agent's.
+	Datacenters map[string]map[string][]*testServiceData
+	// Namespaces holds the services of namespaces other than the token's.
+	Namespaces map[string]map[string][]*testServiceData
+	// LastContact is how far behind the leader stale queries are answered.
+	LastContact time.Duration
 }
 
 func NewTestCatalogClient() Client {
 	return &testCatalogClient{
 		lastIndex: 4,
+		indexes:   map[string]uint64{},
+		calls:     map[string]int{},
 		services: map[string][]*testServiceData{
 			"nomad": {
 				{
 					Address: "192.168.100.1",
+					Port:    4646,
 					Tags: []string{
 						"coredns.enabled",
 						"traefik.enable=true",
@@ -71,6 +111,7 @@ func NewTestCatalogClient() Client {
 			"nomad-client": {
 				{
 					Address: "192.168.100.1",
+					Port:    4646,
 					Tags:    []string{},
 					Meta:    map[string]string{},
 				},
@@ -78,6 +119,7 @@ func NewTestCatalogClient() Client {
 			"traefik": {
 				{
 					Address: "192.168.100.2",
+					Port:    443,
 					Tags: []string{
 						"coredns.enabled",
 						"traefik.enable=true",
@@ -90,6 +132,7 @@ func NewTestCatalogClient() Client {
 			"git": {
 				{
 					Address: "192.168.100.3",
+					Port:    3000,
 					Tags:    []string{"coredns.enabled"},
 					Meta: map[string]string{
 						"coredns-acl": "deny guest; allow public",
@@ -97,6 +140,8 @@ func NewTestCatalogClient() Client {
 				},
 				{
 					Address: "192.168.100.4",
+					Port:    3001,
+					Status:  api.HealthWarning,
 					Tags:    []string{"coredns.enabled"},
 					Meta: map[string]string{
 						"coredns-acl": "deny guest; allow public",
@@ -114,8 +159,69 @@ func (c *testCatalogClient) DeleteService(name string) {
 	delete(c.services, name)
 }
 
-func (c *testCatalogClient) Service(name string, _ string, _ *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
-	sd, ok := c.services[name]
+// Retag replaces the tags of every instance of a service.
+func (c *testCatalogClient) Retag(name string, tags ...string) {
+	for _, instance := range c.services[name] {
+		instance.Tags = tags
+	}
+	c.retagged++
+}
+
+// servicesIn returns the services in the namespace or datacenter queried by qo.
+func (c *testCatalogClient) servicesIn(qo *api.QueryOptions) map[string][]*testServiceData {
+	switch {
+	case qo == nil:
+		return c.services
+	case qo.Namespace != "":
+		return c.Namespaces[qo.Namespace]
+	case qo.Datacenter != "":
+		return c.Datacenters[qo.Datacenter]
+	default:
+		return c.services
+	}
+}
+
+// meta returns the query metadata for a result at index.
+func (c *testCatalogClient) meta(qo *api.QueryOptions, index uint64) *api.QueryMeta {
+	meta := &api.QueryMeta{LastIndex: index, KnownLeader: true}
+	if qo != nil && qo.AllowStale {
+		meta.LastContact = c.LastContact
+	}
+	return meta
+}
+
+// Touch bumps the index of a service, as if its instances changed.
+func (c *testCatalogClient) Touch(name string) {
+	c.indexes[name]++
+}
+
+func (c *testCatalogClient) serviceIndex(name string) uint64 {
+	return c.indexes[name] + 1
+}
+
+// block waits for qo to be cancelled if the client is blocking and index has not changed.
+func (c *testCatalogClient) block(qo *api.QueryOptions, index uint64) error {
+	if !c.Blocking || qo == nil || qo.WaitIndex < index {
+		return nil
+	}
+
+	c.Unlock()
+	defer c.Lock()
+	<-qo.Context().Done()
+	return qo.Context().Err()
+}
+
+func (c *testCatalogClient) Service(name string, _ string, qo *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.calls[name]++
+	if qo != nil {
+		c.LastOptions = *qo
+	}
+	if err := c.block(qo, c.serviceIndex(name)); err != nil {
+		return nil, nil, err
+	}
+	sd, ok := c.servicesIn(qo)[name]
 	if !ok {
 		return []*api.CatalogService{}, nil, fmt.Errorf("Not found")
 	}
@@ -123,28 +229,97 @@ func (c *testCatalogClient) Service(name string, _ string, _ *api.QueryOptions)
 	services := []*api.CatalogService{}
 	for _, nodeService := range sd {
 		services = append(services, &api.CatalogService{
-			ID:          "42",
-			ServiceName: name,
-			Node:        fmt.Sprintf("node-%s", nodeService.Address),
-			Address:     nodeService.Address,
-			ServiceMeta: nodeService.Meta,
-			ServiceTags: nodeService.Tags,
+			ID:                     "42",
+			ServiceID:              fmt.Sprintf("%s-%d", name, nodeService.Port),
+			ServiceName:            name,
+			ServicePort:            nodeService.Port,
+			Node:                   fmt.Sprintf("node-%s", nodeService.Address),
+			Address:                nodeService.Address,
+			ServiceMeta:            nodeService.Meta,
+			ServiceTags:            nodeService.Tags,
+			ServiceAddress:         nodeService.ServiceAddress,
+			ServiceTaggedAddresses: nodeService.taggedAddresses(),
+			TaggedAddresses:        nodeService.NodeTaggedAddresses,
 		})
 	}
-	return services, &api.QueryMeta{}, nil
+	return services, c.meta(qo, c.serviceIndex(name)), nil
 }
 
-func (c *testCatalogClient) Services(*api.QueryOptions) (map[string][]string, *api.QueryMeta, error) {
+func (c *testCatalogClient) Services(qo *api.QueryOptions) (map[string][]string, *api.QueryMeta, error) {
+	c.Lock()
+	defer c.Unlock()
+	if qo != nil {
+		c.LastOptions = *qo
+	}
+	if err := c.block(qo, uint64(len(c.servicesIn(qo)))+c.retagged); err != nil {
+		return nil, nil, err
+	}
 	services := map[string][]string{}
-	for name, svc := range c.services {
+	for name, svc := range c.servicesIn(qo) {
 		services[name] = svc[0].Tags
 	}
 
-	c.lastIndex = uint64(len(services))
-	return services, &api.QueryMeta{LastIndex: c.lastIndex}, nil
+	c.lastIndex = uint64(len(services)) + c.retagged
+	return services, c.meta(qo, c.lastIndex), nil
+}
+
+type testHealthClient struct {
+	catalog *testCatalogClient
+}
+
+func (h *testHealthClient) Service(name string, _ string, _ bool, qo *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	sd, ok := h.catalog.servicesIn(qo)[name]
+	if !ok {
+		return []*api.ServiceEntry{}, nil, fmt.Errorf("Not found")
+	}
+
+	entries := []*api.ServiceEntry{}
+	for _, nodeService := range sd {
+		status := nodeService.Status
+		if status == "" {
+			status = api.HealthPassing
+		}
+
+		node := fmt.Sprintf("node-%s", nodeService.Address)
+		entries = append(entries, &api.ServiceEntry{
+			Node: &api.Node{
+				ID:              "42",
+				Node:            node,
+				Address:         nodeService.Address,
+				TaggedAddresses: nodeService.NodeTaggedAddresses,
+			},
+			Service: &api.AgentService{
+				ID:              fmt.Sprintf("%s-%d", name, nodeService.Port),
+				Service:         name,
+				Tags:            nodeService.Tags,
+				Meta:            nodeService.Meta,
+				Port:            nodeService.Port,
+				Address:         nodeService.ServiceAddress,
+				TaggedAddresses: nodeService.taggedAddresses(),
+			},
+			Checks: api.HealthChecks{
+				{Node: node, CheckID: "serfHealth", Status: status},
+			},
+		})
+	}
+	return entries, &api.QueryMeta{LastIndex: h.catalog.serviceIndex(name)}, nil
+}
+
+type testNamespaceClient struct {
+	catalog *testCatalogClient
+}
+
+func (n *testNamespaceClient) List(_ *api.QueryOptions) ([]*api.Namespace, *api.QueryMeta, error) {
+	namespaces := []*api.Namespace{}
+	for name := range n.catalog.Namespaces {
+		namespaces = append(namespaces, &api.Namespace{Name: name})
+	}
+	return namespaces, &api.QueryMeta{LastIndex: uint64(len(namespaces)) + 1}, nil
 }
 
 type testKVClient struct {
+	// LastOptions are the options of the last query made.
+	LastOptions api.QueryOptions
 	Keys        map[string]*api.KVPair
 	keysIndex   uint64
 	Prefixes    map[string]api.KVPairs
@@ -175,7 +350,10 @@ func NewTestKVClient() KVClient {
 	}
 }
 
-func (kv *testKVClient) Get(path string, _ *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+func (kv *testKVClient) Get(path string, qo *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	if qo != nil {
+		kv.LastOptions = *qo
+	}
 	kv.keysIndex++
 	return kv.Keys[path], &api.QueryMeta{LastIndex: kv.keysIndex}, nil
 }
@@ -184,3 +362,13 @@ func (kv *testKVClient) List(prefix string, _ *api.QueryOptions) (api.KVPairs, *
 	kv.prefixIndex++
 	return kv.Prefixes[prefix], &api.QueryMeta{LastIndex: kv.prefixIndex}, nil
 }
+
+// testZone returns a file plugin serving an empty example.com. zone.
+func testZone(t *testing.T) file.File {
+	t.Helper()
+	zone, err := file.Parse(strings.NewReader("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300\n"), "example.com.", "test", 0)
+	if err != nil {
+		t.Fatalf("could not parse zone: %s", err)
+	}
+	return file.File{Zones: file.Zones{Z: map[string]*file.Zone{"example.com.": zone}, Names: []string{"example.com."}}}
+}
@@ -4,22 +4,35 @@
 package catalog
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/hashicorp/consul/api"
 )
 
 const ServiceProxyTag = "@service_proxy"
 
+// NamespaceWildcard serves services in every namespace.
+const NamespaceWildcard = "*"
+
+const (
+	// TagMatchAny exposes services with any of the configured tags.
+	TagMatchAny = "any"
+	// TagMatchAll exposes services with all of the configured tags.
+	TagMatchAll = "all"
+)
+
 type WatchType interface {
 	Name() string
-	Fetch(*Catalog, *api.QueryOptions) (uint64, error)
+	Fetch(*Catalog, *api.QueryOptions) (*api.QueryMeta, error)
 	Process(*Catalog) (ServiceMap, []string, error)
 }
 
@@ -31,6 +44,8 @@ type Watch struct {
 	refreshed time.Time
 	watcher   WatchType
 	ready     bool
+	// records are the services and aliases this watch adds to WatchRecords.
+	records map[string]int
 }
 
 func NewWatch(impl WatchType) *Watch {
@@ -41,66 +56,153 @@ func NewWatch(impl WatchType) *Watch {
 	return w
 }
 
-func (w *Watch) Resolve(catalog *Catalog) (bool, error) {
+// Run resolves the watch until ctx is done, backing off on errors.
+func (w *Watch) Run(ctx context.Context, catalog *Catalog) {
+	Log.Infof("Starting lookup for %s", w.Name())
+	for ctx.Err() == nil {
+		Log.Debugf("Looking up %s", w.Name())
+
+		onUpdateError := func(err error, cooldown time.Duration) {
+			Log.Errorf("Could not lookup %s, retrying in %vs: %v", w.Name(), cooldown.Truncate(time.Second), err)
+		}
+		changed := false
+		err := backoff.RetryNotify(func() (err error) {
+			changed, err = w.Resolve(ctx, catalog)
+			return err
+		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx), onUpdateError)
+
+		if err != nil || !changed {
+			continue
+		}
+
+		catalog.Lock()
+		catalog.lastUpdate = time.Now()
+		catalog.Unlock()
+	}
+	Log.Infof("Stopped lookup for %s", w.Name())
+}
+
+func (w *Watch) Resolve(ctx context.Context, catalog *Catalog) (bool, error) {
 	w.RLock()
 	lastIndex := w.LastIndex
 	w.RUnlock()
 
-	opts := &api.QueryOptions{
-		WaitTime:  watchTimeout,
-		WaitIndex: lastIndex,
+	opts := (&api.QueryOptions{
+		WaitTime:          watchTimeout,
+		WaitIndex:         lastIndex,
+		Token:             catalog.aclToken(),
+		Namespace:         catalog.queryNamespace(),
+		Partition:         catalog.Partition,
+		AllowStale:        catalog.Consistency == ConsistencyStale,
+		RequireConsistent: catalog.Consistency == ConsistencyConsistent,
+		UseCache:          catalog.UseCache,
+	}).WithContext(ctx)
+	if catalog.UseCache {
+		opts.MaxAge = catalog.MaxStale
 	}
 
-	nextIndex, err := w.watcher.Fetch(catalog, opts)
+	meta, err := w.watcher.Fetch(catalog, opts)
+	if err == nil && opts.AllowStale && catalog.MaxStale > 0 && meta.LastContact > catalog.MaxStale {
+		// too stale to be served, ask the leader for the current state without blocking
+		Log.Warningf("Results for %s were %v stale, querying the leader", w.Name(), meta.LastContact)
+		opts.AllowStale = false
+		opts.WaitIndex = 0
+		meta, err = w.watcher.Fetch(catalog, opts)
+	}
 
+	source, _ := w.metricsSource()
 	if err != nil {
+		if ctx.Err() == nil {
+			WatchResolveCount.WithLabelValues(source, "error").Inc()
+		}
 		return false, err
 	}
 
-	if nextIndex == opts.WaitIndex {
+	WatchLastContact.WithLabelValues(source).Set(meta.LastContact.Seconds())
+	knownLeader := 0.0
+	if meta.KnownLeader {
+		knownLeader = 1
+	}
+	WatchKnownLeader.WithLabelValues(source).Set(knownLeader)
+
+	nextIndex := meta.LastIndex
+	if nextIndex == lastIndex {
 		// watch timed out, safe to retry
 		Log.Debugf("No changes found, %d", nextIndex)
 		w.Lock()
 		w.refreshed = time.Now()
 		w.Unlock()
+		w.succeeded()
 		return false, nil
 	}
 
 	// reset the index if it goes backwards
 	// https://www.consul.io/api/features/blocking.html#implementation-details
-	if nextIndex < opts.WaitIndex {
+	if nextIndex < lastIndex {
 		Log.Debugf("Resetting consul kv watch index")
 		nextIndex = 0
 	}
 
+	processStart := time.Now()
 	services, found, err := w.watcher.Process(catalog)
+	WatchProcessDuration.WithLabelValues(source).Observe(time.Since(processStart).Seconds())
 	if err != nil {
+		WatchResolveCount.WithLabelValues(source, "error").Inc()
 		return false, err
 	}
 
+	aliases := 0
+	for _, svc := range services {
+		svc.Source = w.Name()
+		if svc.AliasOf != "" {
+			aliases++
+		}
+	}
+
 	w.Lock()
+	if ctx.Err() == nil {
+		w.recordMetrics(nextIndex, len(services)-aliases, aliases)
+	}
 	w.ready = true
 	w.services = services
 	w.LastIndex = nextIndex
 	w.refreshed = time.Now()
 	w.Unlock()
+	if catalog.Snapshot != nil {
+		catalog.Snapshot.Save(w.Name(), services)
+	}
+	w.succeeded()
+	catalog.publish()
 	Log.Debugf("Serving %d records from %s: %s", len(found), w.watcher.Name(), strings.Join(found, ","))
 	return true, nil
 }
 
+// succeeded records a successful Resolve in the watch's metrics.
+func (w *Watch) succeeded() {
+	source, _ := w.metricsSource()
+	WatchResolveCount.WithLabelValues(source, "success").Inc()
+	WatchLastRefresh.WithLabelValues(source).SetToCurrentTime()
+}
+
 func (w *Watch) Name() string {
 	return w.watcher.Name()
 }
 
 func (w *Watch) Get(name string) *Service {
-	return w.services.Find(name)
+	return w.Known().Find(name)
 }
 
+// Known returns the services found by the last successful Resolve. The returned map is
+// replaced, never modified, by later calls to Resolve.
 func (w *Watch) Known() ServiceMap {
+	w.RLock()
+	defer w.RUnlock()
 	return w.services
 }
 
 func (w *Watch) Ready() bool {
+	w.RLock()
+	defer w.RUnlock()
 	return w.ready
 }
 
@@ -111,7 +213,7 @@ func staticEntriesToServiceMap(c *Catalog, entries StaticEntries) (ServiceMap, [
 	for name, entry := range entries {
 		target := entry.Target
 		addresses := entry.Addresses
-		if len(addresses) == 0 && target == "" {
+		if len(addresses) == 0 && len(entry.AddressesByZone) == 0 && target == "" {
 			Log.Warningf("Ignoring service %s, no target or addresses found!", name)
 			continue
 		}
@@ -138,6 +240,22 @@ func staticEntriesToServiceMap(c *Catalog, entries StaticEntries) (ServiceMap, [
 			}
 		}
 
+		for zone, zoneAddresses := range entry.AddressesByZone {
+			if service.ZoneAddresses == nil {
+				service.ZoneAddresses = map[string][]net.IP{}
+			}
+
+			service.ZoneAddresses[zone] = []net.IP{}
+			for _, addrStr := range zoneAddresses {
+				ip := net.ParseIP(addrStr)
+				if ip == nil {
+					Log.Warningf("Ignoring address %s in zone %s for static service %s: could not parse IP", addrStr, zone, name)
+					continue
+				}
+				service.ZoneAddresses[zone] = append(service.ZoneAddresses[zone], ip)
+			}
+		}
+
 		if c.ACLTag != "" {
 			err := c.parseACL(service, entry.ACL)
 			if err != nil {
@@ -173,13 +291,13 @@ func (src *WatcKVPrefix) Name() string {
 	return fmt.Sprintf("static services at prefix %s", src.Prefix)
 }
 
-func (src *WatcKVPrefix) Fetch(catalog *Catalog, qo *api.QueryOptions) (uint64, error) {
+func (src *WatcKVPrefix) Fetch(catalog *Catalog, qo *api.QueryOptions) (*api.QueryMeta, error) {
 	entryPairs, meta, err := catalog.kv.List(src.Prefix, qo)
 	if err != nil {
-		return qo.WaitIndex, err
+		return nil, err
 	}
 	src.entries = entryPairs
-	return meta.LastIndex, nil
+	return meta, nil
 }
 
 func (src *WatcKVPrefix) Process(catalog *Catalog) (ServiceMap, []string, error) {
@@ -208,13 +326,13 @@ func (src *WatchKVPath) Name() string {
 	return fmt.Sprintf("static services from key %s", src.Key)
 }
 
-func (src *WatchKVPath) Fetch(catalog *Catalog, qo *api.QueryOptions) (uint64, error) {
+func (src *WatchKVPath) Fetch(catalog *Catalog, qo *api.QueryOptions) (*api.QueryMeta, error) {
 	configPair, meta, err := catalog.kv.Get(src.Key, qo)
 	if err != nil {
-		return qo.WaitIndex, err
+		return nil, err
 	}
 	src.data = configPair
-	return meta.LastIndex, nil
+	return meta, nil
 }
 
 func (src *WatchKVPath) Process(catalog *Catalog) (ServiceMap, []string, error) {
@@ -228,106 +346,601 @@ func (src *WatchKVPath) Process(catalog *Catalog) (ServiceMap, []string, error)
 	return services, found, nil
 }
 
+// WatchACLZones watches a KV key holding the acl zones of the catalog, as a json object
+// of zone names to lists of CIDR ranges.
+type WatchACLZones struct {
+	Key    string
+	data   *api.KVPair
+	loaded bool
+}
+
+func (src *WatchACLZones) Name() string {
+	return fmt.Sprintf("acl zones from key %s", src.Key)
+}
+
+func (src *WatchACLZones) Fetch(catalog *Catalog, qo *api.QueryOptions) (*api.QueryMeta, error) {
+	zonesPair, meta, err := catalog.kv.Get(src.Key, qo)
+	if err != nil {
+		return nil, err
+	}
+	src.data = zonesPair
+	return meta, nil
+}
+
+// Process serves the zones found at Key, or only the catalog's Networks if the key is
+// missing. Once zones have been read, the last ones served are kept if the key cannot
+// be parsed.
+func (src *WatchACLZones) Process(catalog *Catalog) (ServiceMap, []string, error) {
+	if src.data == nil {
+		Log.Warningf("No acl zones found at %s, using acl_zone networks only", src.Key)
+		src.loaded = true
+		catalog.setZones(map[string][]*net.IPNet{})
+		return ServiceMap{}, []string{}, nil
+	}
+
+	zones, found, err := parseACLZones(src.data.Value)
+	if err != nil {
+		err = fmt.Errorf("could not parse acl zones at %s: %w", src.Key, err)
+		if src.loaded {
+			return nil, nil, err
+		}
+
+		Log.Warningf("%s, using acl_zone networks only", err)
+		catalog.setZones(map[string][]*net.IPNet{})
+		return ServiceMap{}, []string{}, nil
+	}
+
+	src.loaded = true
+	catalog.setZones(zones)
+	return ServiceMap{}, found, nil
+}
+
+// parseACLZones returns the networks of every zone in a json object of CIDR lists keyed
+// by zone name, and the names of those zones.
+func parseACLZones(value []byte) (map[string][]*net.IPNet, []string, error) {
+	ranges := map[string][]string{}
+	if err := json.Unmarshal(value, &ranges); err != nil {
+		return nil, nil, err
+	}
+
+	zones := map[string][]*net.IPNet{}
+	found := []string{}
+	for name, cidrs := range ranges {
+		zones[name] = []*net.IPNet{}
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to parse network range <%s> of acl zone <%s>", cidr, name)
+			}
+			zones[name] = append(zones[name], network)
+		}
+		found = append(found, name)
+	}
+
+	return zones, found, nil
+}
+
+// WatchConsulCatalog watches the list of services in the catalog, and maintains a
+// WatchConsulService for every service exposed by its tags.
 type WatchConsulCatalog struct {
-	Tag  string
-	data map[string][]string
+	// Tags services must have to be served, or not have, if prefixed with `!`.
+	Tags []string
+	// Match is either TagMatchAny or TagMatchAll.
+	Match string
+	// Namespace to watch services in, instead of the catalog's. Services are published as
+	// `name.namespace.ns` if set.
+	Namespace string
+	// Datacenter to watch services in, instead of the agent's. Services are published as
+	// `name.datacenter.dc` if set.
+	Datacenter string
+	data       map[string][]string
+
+	childLock sync.Mutex
+	children  map[string]*Watch
+	stopped   bool
 }
 
 func (src *WatchConsulCatalog) Name() string {
-	return fmt.Sprintf("consul catalog services tagged %s", src.Tag)
+	name := fmt.Sprintf("consul catalog services tagged %s of %s", src.Match, strings.Join(src.Tags, ", "))
+	if len(src.Tags) == 1 {
+		name = fmt.Sprintf("consul catalog services tagged %s", src.Tags[0])
+	}
+
+	if src.Namespace != "" {
+		name += " in namespace " + src.Namespace
+	}
+	if src.Datacenter != "" {
+		name += " in " + src.Datacenter
+	}
+	return name
+}
+
+// Exposes returns whether a service with the given tags should be served.
+func (src *WatchConsulCatalog) Exposes(serviceTags []string) bool {
+	has := map[string]bool{}
+	for _, tag := range serviceTags {
+		has[tag] = true
+	}
+
+	wanted := 0
+	matched := 0
+	for _, tag := range src.Tags {
+		if negated, ok := strings.CutPrefix(tag, "!"); ok {
+			if has[negated] {
+				return false
+			}
+			continue
+		}
+
+		wanted++
+		if has[tag] {
+			matched++
+		}
+	}
+
+	switch {
+	case wanted == 0:
+		// only negative tags were given, every other service is exposed
+		return true
+	case src.Match == TagMatchAll:
+		return matched == wanted
+	default:
+		return matched > 0
+	}
 }
 
-func (src *WatchConsulCatalog) Fetch(catalog *Catalog, qo *api.QueryOptions) (uint64, error) {
+func (src *WatchConsulCatalog) Fetch(catalog *Catalog, qo *api.QueryOptions) (*api.QueryMeta, error) {
+	qo.Datacenter = src.Datacenter
+	if src.Namespace != "" {
+		qo.Namespace = src.Namespace
+	}
 	svcs, meta, err := catalog.client.Services(qo)
 	if err != nil {
-		return qo.WaitIndex, err
+		return nil, err
 	}
 	src.data = svcs
-	return meta.LastIndex, nil
+	return meta, nil
 }
 
 func (src *WatchConsulCatalog) Process(catalog *Catalog) (ServiceMap, []string, error) {
-	services := ServiceMap{}
-	found := []string{}
+	src.childLock.Lock()
+	defer src.childLock.Unlock()
+	if src.stopped {
+		return ServiceMap{}, []string{}, nil
+	}
+
+	if src.children == nil {
+		src.children = map[string]*Watch{}
+	}
 
+	found := []string{}
+	exposed := map[string]string{}
 	for svc, serviceTags := range src.data {
-		target := svc
-		exposed := false
+		// do not publish services without the tags
+		if !src.Exposes(serviceTags) {
+			continue
+		}
 
+		target := src.publishedName(svc)
 		for _, tag := range serviceTags {
-			switch tag {
-			case catalog.ProxyTag:
-				if catalog.ProxyTag != "" {
-					target = ServiceProxyTag
-				}
-			case src.Tag:
-				exposed = true
-			default:
-				Log.Debugf("ignoring unknown tag %s for svc %s", tag, svc)
+			if catalog.ProxyTag != "" && tag == catalog.ProxyTag {
+				target = ServiceProxyTag
 			}
 		}
 
-		// do not publish services without the tag
-		if !exposed {
+		exposed[svc] = target
+		found = append(found, svc)
+	}
+
+	for svc, child := range src.children {
+		target, ok := exposed[svc]
+		if ok && child.watcher.(*WatchConsulService).Target == target {
 			continue
 		}
 
-		hydratedServices, _, err := catalog.client.Service(svc, "", nil)
-		if err != nil {
-			// couldn't find service, ignore
-			Log.Debugf("Failed to fetch service info for %s: %e", svc, err)
+		Log.Debugf("Stopping watch for service %s", svc)
+		catalog.RemoveSource(child)
+		delete(src.children, svc)
+	}
+
+	for svc, target := range exposed {
+		if _, ok := src.children[svc]; ok {
 			continue
 		}
 
-		service := NewService(svc, target)
+		Log.Debugf("Starting watch for service %s", svc)
+		child := NewWatch(&WatchConsulService{Service: svc, Namespace: src.Namespace, Datacenter: src.Datacenter, Target: target})
+		src.children[svc] = child
+		catalog.AddSource(child)
+	}
 
-		if len(hydratedServices) > 0 {
-			for _, svc := range hydratedServices {
-				service.Addresses = append(service.Addresses, net.ParseIP(svc.Address))
-			}
-			metadata := hydratedServices[0].ServiceMeta
-			if catalog.ACLTag != "" {
-				acl, exists := metadata[catalog.ACLTag]
-				if !exists {
-					Log.Warningf("No ACL found for %s", svc)
-					continue
+	return ServiceMap{}, found, nil
+}
+
+// publishedName returns the name a service in this catalog is served as.
+func (src *WatchConsulCatalog) publishedName(name string) string {
+	return inDatacenter(inNamespace(name, src.Namespace), src.Datacenter)
+}
+
+// Stop removes the watches for every service in this catalog, and prevents new ones from
+// being added.
+func (src *WatchConsulCatalog) Stop(catalog *Catalog) {
+	src.childLock.Lock()
+	defer src.childLock.Unlock()
+	src.stopped = true
+	for svc, child := range src.children {
+		catalog.RemoveSource(child)
+		delete(src.children, svc)
+	}
+}
+
+// WatchConsulNamespaces watches the namespaces in the catalog's partition, and maintains
+// a WatchConsulCatalog for each of them.
+type WatchConsulNamespaces struct {
+	Tags     []string
+	Match    string
+	data     []*api.Namespace
+	children map[string]*Watch
+}
+
+func (src *WatchConsulNamespaces) Name() string {
+	return "consul namespaces"
+}
+
+func (src *WatchConsulNamespaces) Fetch(catalog *Catalog, qo *api.QueryOptions) (*api.QueryMeta, error) {
+	namespaces, meta, err := catalog.namespaces.List(qo)
+	if err != nil {
+		return nil, err
+	}
+	src.data = namespaces
+	return meta, nil
+}
+
+func (src *WatchConsulNamespaces) Process(catalog *Catalog) (ServiceMap, []string, error) {
+	if src.children == nil {
+		src.children = map[string]*Watch{}
+	}
+
+	found := []string{}
+	exists := map[string]bool{}
+	for _, ns := range src.data {
+		exists[ns.Name] = true
+		found = append(found, ns.Name)
+	}
+
+	for ns, child := range src.children {
+		if exists[ns] {
+			continue
+		}
+
+		Log.Debugf("Stopping watch for namespace %s", ns)
+		catalog.RemoveSource(child)
+		child.watcher.(*WatchConsulCatalog).Stop(catalog)
+		delete(src.children, ns)
+	}
+
+	for _, ns := range found {
+		if _, ok := src.children[ns]; ok {
+			continue
+		}
+
+		Log.Debugf("Starting watch for namespace %s", ns)
+		child := NewWatch(&WatchConsulCatalog{Tags: src.Tags, Match: src.Match, Namespace: ns})
+		src.children[ns] = child
+		catalog.AddSource(child)
+	}
+
+	return ServiceMap{}, found, nil
+}
+
+// WatchConsulService watches the instances of a single catalog service.
+type WatchConsulService struct {
+	Service    string
+	Namespace  string
+	Datacenter string
+	Target     string
+	instances  []*api.CatalogService
+	statuses   []string
+}
+
+func (src *WatchConsulService) Name() string {
+	name := fmt.Sprintf("consul catalog service %s", src.Service)
+	if src.Namespace != "" {
+		name += " in namespace " + src.Namespace
+	}
+	if src.Datacenter != "" {
+		name += " in " + src.Datacenter
+	}
+	return name
+}
+
+func (src *WatchConsulService) Fetch(catalog *Catalog, qo *api.QueryOptions) (*api.QueryMeta, error) {
+	qo.Datacenter = src.Datacenter
+	if src.Namespace != "" {
+		qo.Namespace = src.Namespace
+	}
+	if catalog.HealthStatus == "" {
+		instances, meta, err := catalog.client.Service(src.Service, "", qo)
+		if err != nil {
+			return nil, err
+		}
+		src.instances = instances
+		src.statuses = nil
+		return meta, nil
+	}
+
+	entries, meta, err := catalog.health.Service(src.Service, "", false, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	src.instances = make([]*api.CatalogService, 0, len(entries))
+	src.statuses = make([]string, 0, len(entries))
+	for _, entry := range entries {
+		src.instances = append(src.instances, catalogServiceFromEntry(entry))
+		src.statuses = append(src.statuses, entry.Checks.AggregatedStatus())
+	}
+	return meta, nil
+}
+
+func (src *WatchConsulService) Process(catalog *Catalog) (ServiceMap, []string, error) {
+	services := ServiceMap{}
+	found := []string{}
+	svc := src.publishedName(src.Service)
+	service := NewService(svc, src.Target)
+	if src.Target == svc {
+		service.Upstream = consulDNSName(src.Service, src.Namespace, src.Datacenter)
+	}
+
+	if len(src.instances) > 0 {
+		for _, instance := range src.healthy(catalog) {
+			addr, host, port := instanceAddress(instance, catalog.AddressTags)
+			switch {
+			case addr != nil:
+				service.Addresses = append(service.Addresses, addr)
+			case host != "":
+				if !slices.Contains(service.Hosts, host) {
+					service.Hosts = append(service.Hosts, host)
 				}
+			default:
+				Log.Warningf("Ignoring instance %s of %s on node %s: no address found", instance.ServiceID, svc, instance.Node)
+				continue
+			}
 
-				if err := catalog.parseACLString(service, acl); err != nil {
-					Log.Warningf("Ignoring service %s: %s", service.Name, err)
+			tagged := taggedAddresses(instance)
+			service.Instances = append(service.Instances, &ServiceInstance{
+				ID:            instance.ServiceID,
+				Node:          instance.Node,
+				Address:       addr,
+				Host:          host,
+				Port:          port,
+				ZoneAddresses: tagged,
+			})
+			for zone := range tagged {
+				if service.ZoneAddresses == nil {
+					service.ZoneAddresses = map[string][]net.IP{}
 				}
+				service.ZoneAddresses[zone] = nil
 			}
+		}
 
-			if catalog.AliasTag != "" {
-				if aliases, exists := metadata[catalog.AliasTag]; exists {
-					matches := multiValueMetadataSplitter.Split(aliases, -1)
-					for _, match := range matches {
-						services[match] = aliasForService(match, service)
-					}
-					found = append(found, matches...)
+		// instances without a tagged address for a zone are served at their own there
+		for zone := range service.ZoneAddresses {
+			addrs := []net.IP{}
+			for _, instance := range service.Instances {
+				if addr := instance.In(zone).Address; addr != nil {
+					addrs = append(addrs, addr)
 				}
 			}
-		} else {
-			Log.Warningf("No services found for %s, check the permissions for your token", svc)
+			service.ZoneAddresses[zone] = addrs
 		}
+		metadata := src.instances[0].ServiceMeta
+		if catalog.ACLTag != "" {
+			acl, exists := metadata[catalog.ACLTag]
+			if !exists {
+				Log.Warningf("No ACL found for %s", svc)
+				return services, found, nil
+			}
 
-		services[svc] = service
-		Log.Debugf("serving: %+v", service)
-		found = append(found, svc)
+			if err := catalog.parseACLString(service, acl); err != nil {
+				Log.Warningf("Ignoring service %s: %s", service.Name, err)
+			}
+		}
+
+		if catalog.AliasTag != "" {
+			if aliases, exists := metadata[catalog.AliasTag]; exists {
+				for _, match := range multiValueMetadataSplitter.Split(aliases, -1) {
+					alias := src.publishedName(match)
+					services[alias] = aliasForService(alias, service)
+					found = append(found, alias)
+				}
+			}
+		}
+	} else {
+		Log.Warningf("No services found for %s, check the permissions for your token", svc)
 	}
 
+	services[svc] = service
+	Log.Debugf("serving: %+v", service)
+	found = append(found, svc)
+
 	return services, found, nil
 }
 
+// publishedName returns the name a service or alias of this service is served as.
+func (src *WatchConsulService) publishedName(name string) string {
+	return inDatacenter(inNamespace(name, src.Namespace), src.Datacenter)
+}
+
+// healthy returns the instances that should be served given the catalog's health configuration.
+func (src *WatchConsulService) healthy(catalog *Catalog) []*api.CatalogService {
+	if catalog.HealthStatus == "" || src.statuses == nil {
+		return src.instances
+	}
+
+	healthy := []*api.CatalogService{}
+	for idx, instance := range src.instances {
+		status := src.statuses[idx]
+		if status == api.HealthPassing || (status == api.HealthWarning && catalog.HealthStatus == api.HealthWarning) {
+			healthy = append(healthy, instance)
+			continue
+		}
+		Log.Debugf("Ignoring instance %s of %s on node %s with status %s", instance.ServiceID, src.Service, instance.Node, status)
+	}
+
+	if len(healthy) == 0 {
+		if catalog.HealthFallback {
+			Log.Warningf("No healthy instances of %s found, serving all %d instances", src.Service, len(src.instances))
+			return src.instances
+		}
+		Log.Warningf("No healthy instances of %s found", src.Service)
+	}
+
+	return healthy
+}
+
+// instanceAddress returns the address an instance is served at, along with its port: the
+// first of the service's tagged addresses named in tags, or its service address. Services
+// registered without an address are served at the first of their node's tagged addresses
+// named in tags, or the node's address. Addresses that are not IPs are returned as a host.
+func instanceAddress(instance *api.CatalogService, tags []string) (addr net.IP, host string, port int) {
+	address := ""
+	port = instance.ServicePort
+	for _, tag := range tags {
+		if tagged, ok := instance.ServiceTaggedAddresses[tag]; ok && tagged.Address != "" {
+			address = tagged.Address
+			if tagged.Port != 0 {
+				port = tagged.Port
+			}
+			break
+		}
+	}
+
+	if address == "" {
+		address = instance.ServiceAddress
+	}
+
+	if address == "" {
+		for _, tag := range tags {
+			if tagged := instance.TaggedAddresses[tag]; tagged != "" {
+				address = tagged
+				break
+			}
+		}
+	}
+
+	if address == "" {
+		address = instance.Address
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		return ip, "", port
+	}
+	return nil, address, port
+}
+
+// taggedAddresses returns the tagged addresses of an instance by tag, for clients in acl
+// zones named like the tags. Those of its node are only used if the service registered
+// without an address of its own, as consul tags every node with its lan and wan addresses.
+func taggedAddresses(instance *api.CatalogService) map[string]net.IP {
+	nodeTagged := instance.TaggedAddresses
+	if instance.ServiceAddress != "" {
+		nodeTagged = nil
+	}
+
+	if len(nodeTagged) == 0 && len(instance.ServiceTaggedAddresses) == 0 {
+		return nil
+	}
+
+	tagged := map[string]net.IP{}
+	for tag, addr := range nodeTagged {
+		if ip := net.ParseIP(addr); ip != nil {
+			tagged[tag] = ip
+		}
+	}
+
+	for tag, addr := range instance.ServiceTaggedAddresses {
+		if ip := net.ParseIP(addr.Address); ip != nil {
+			tagged[tag] = ip
+		}
+	}
+	return tagged
+}
+
+// catalogServiceFromEntry converts a health endpoint result into a catalog one.
+func catalogServiceFromEntry(entry *api.ServiceEntry) *api.CatalogService {
+	return &api.CatalogService{
+		ID:                       entry.Node.ID,
+		Node:                     entry.Node.Node,
+		Address:                  entry.Node.Address,
+		Datacenter:               entry.Node.Datacenter,
+		TaggedAddresses:          entry.Node.TaggedAddresses,
+		NodeMeta:                 entry.Node.Meta,
+		ServiceID:                entry.Service.ID,
+		ServiceName:              entry.Service.Service,
+		ServiceAddress:           entry.Service.Address,
+		ServiceTaggedAddresses:   entry.Service.TaggedAddresses,
+		ServiceTags:              entry.Service.Tags,
+		ServiceMeta:              entry.Service.Meta,
+		ServicePort:              entry.Service.Port,
+		Namespace:                entry.Service.Namespace,
+		Partition:                entry.Service.Partition,
+		ServiceEnableTagOverride: entry.Service.EnableTagOverride,
+	}
+}
+
+// inNamespace returns the name a service is published as in a namespace other than the
+// catalog's, suffixed with `.ns` so it cannot be mistaken for a datacenter.
+func inNamespace(name, namespace string) string {
+	if namespace == "" {
+		return name
+	}
+	return name + "." + namespace + ".ns"
+}
+
+// inDatacenter returns the name a service is published as in a datacenter other than
+// the agent's, suffixed with `.dc` so it cannot be mistaken for a namespace.
+func inDatacenter(name, datacenter string) string {
+	if datacenter == "" {
+		return name
+	}
+	return name + "." + datacenter + ".dc"
+}
+
+// consulDNSName returns the name consul's DNS interface serves a service in a namespace
+// and datacenter other than the agent's at, or an empty string if in neither.
+func consulDNSName(service, namespace, datacenter string) string {
+	if namespace == "" && datacenter == "" {
+		return ""
+	}
+
+	name := service + ".service"
+	if namespace != "" {
+		name += "." + namespace + ".ns"
+	}
+	if datacenter != "" {
+		name += "." + datacenter + ".dc"
+	}
+	return name + ".consul"
+}
+
 var multiValueMetadataSplitter = regexp.MustCompile(`;\s*`)
 
 func aliasForService(name string, service *Service) *Service {
 	alias := NewService(name, service.Target)
+	alias.AliasOf = service.Name
 	alias.ACL = service.ACL
 	alias.Addresses = service.Addresses
+	alias.Hosts = service.Hosts
+	alias.ZoneAddresses = service.ZoneAddresses
+	alias.Instances = service.Instances
+	alias.Upstream = service.Upstream
 	return alias
 }
 
 var _ WatchType = &WatchConsulCatalog{}
+var _ WatchType = &WatchConsulService{}
+var _ WatchType = &WatchConsulNamespaces{}
 var _ WatchType = &WatchKVPath{}
+var _ WatchType = &WatchACLZones{}
 var _ WatchType = &WatcKVPrefix{}